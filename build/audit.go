@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// append-only audit log: one json line per executed command.
+// every line carries the hash of the previous line, so removing or editing
+// a line breaks the chain (see verifyAuditLog).
+
+const AUDIT_GENESIS string = "0000000000000000000000000000000000000000000000000000000000000000"
+
+type AuditEntry struct {
+	Time      string `json:"time"`
+	Remote    string `json:"remote"`
+	Principal string `json:"principal"`
+	Cmd       string `json:"cmd"`
+	Target    string `json:"target,omitempty"`
+	Status    string `json:"status"`
+	Committed bool   `json:"committed"`
+	Prev      string `json:"prev"`
+	Hash      string `json:"hash,omitempty"`
+}
+
+type AuditLog struct {
+	f    *os.File
+	last string // hash of the last line written
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	last := AUDIT_GENESIS
+	// continue the chain of an existing log
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 4096), 1024*1024)
+		for scanner.Scan() {
+			var e AuditEntry
+			if json.Unmarshal(scanner.Bytes(), &e) == nil && e.Hash != "" {
+				last = e.Hash
+			}
+		}
+		f.Close()
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{f: f, last: last}, nil
+}
+
+func hashAuditEntry(e AuditEntry) string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// writes the entries of one program, once we know if it was committed
+func (a *AuditLog) write(entries []AuditEntry, committed bool) {
+	for _, e := range entries {
+		e.Committed = committed
+		e.Prev = a.last
+		e.Hash = hashAuditEntry(e)
+		b, _ := json.Marshal(e)
+		if _, err := a.f.Write(append(b, '\n')); err != nil {
+			log.Printf("audit log write failed: %v", err)
+			return
+		}
+		a.last = e.Hash
+	}
+}
+
+// returns the line number of the first broken entry, 0 if the chain is intact
+func verifyAuditLog(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	prev := AUDIT_GENESIS
+	n := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 4096), 1024*1024)
+	for scanner.Scan() {
+		n++
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return n, nil
+		}
+		if e.Prev != prev || hashAuditEntry(e) != e.Hash {
+			return n, nil
+		}
+		prev = e.Hash
+	}
+	return 0, scanner.Err()
+}
+
+func runVerifyAudit(path string) int {
+	n, err := verifyAuditLog(path)
+	if err != nil {
+		fmt.Printf("audit log unreadable: %v\n", err)
+		return 255
+	} else if n != 0 {
+		fmt.Printf("audit log broken at line %d\n", n)
+		return 1
+	}
+	fmt.Printf("audit log ok\n")
+	return 0
+}
+
+// remembers an executed command until the program commits or rolls back
+func (env *ProgramEnv) recordAudit(cmd Cmd, r int) {
+	if env.globals.audit == nil {
+		return
+	}
+	name, target := auditCmdInfo(cmd)
+	if name == "" {
+		return
+	}
+	env.audit = append(env.audit, AuditEntry{
+		Time:      env.globals.now().UTC().Format(time.RFC3339Nano),
+		Remote:    env.remote,
+		Principal: env.principal,
+		Cmd:       name,
+		Target:    target,
+		Status:    auditStatus(r),
+	})
+}
+
+// passwords are never part of an entry
+func auditCmdInfo(cmd Cmd) (string, string) {
+	switch c := cmd.(type) {
+	case CmdAsPrincipal:
+		return "as_principal", c.principal
+	case CmdCreatePr:
+		return "create_principal", c.principal
+	case CmdChangePw:
+		return "change_password", c.principal
+	case CmdSet:
+		if len(c.path) > 0 {
+			return "set", c.ident + "." + strings.Join(c.path, ".")
+		}
+		return "set", c.ident
+	case CmdLocal:
+		return "local", c.ident
+	case CmdAppend:
+		return "append", c.ident
+	case CmdDeleteVar:
+		return "delete", c.ident
+	case CmdForeach:
+		return "foreach", c.identL
+	case CmdSort:
+		return "sort", c.ident
+	case CmdSetDeleg:
+		return "set_delegation", auditDelegation(c.tgt, c.q, c.right, c.p)
+	case CmdDeleteDeleg:
+		return "delete_delegation", auditDelegation(c.tgt, c.q, c.right, c.p)
+	case CmdSetDenial:
+		return "set_denial", auditDelegation(c.tgt, c.q, c.right, c.p)
+	case CmdDeleteDenial:
+		return "delete_denial", auditDelegation(c.tgt, c.q, c.right, c.p)
+	case CmdDefaultDeleg:
+		return "default_delegator", c.p
+	case CmdReturn:
+		return "return", ""
+	case CmdReturnMeta:
+		return "return_meta", c.ident
+	case CmdReturnVersion:
+		return "return_version", c.ident
+	case CmdRevert:
+		return "revert", c.ident
+	case CmdSetHistory:
+		return "set_history", c.ident
+	case CmdDefineProc:
+		return "define_procedure", c.name
+	case CmdCall:
+		return "call", c.name
+	case CmdOnWrite:
+		return "on_write", c.ident
+	case CmdReject:
+		return "reject", ""
+	case CmdSetQuota:
+		return "set_quota", c.p
+	case CmdShowQuota:
+		return "show_quota", c.p
+	case CmdExit:
+		return "exit", ""
+	case CmdGrantAdmin:
+		return "grant_admin", c.p
+	case CmdRevokeAdmin:
+		return "revoke_admin", c.p
+	case CmdShowLockouts:
+		return "show_lockouts", ""
+	case CmdShowIndexes:
+		return "show_indexes", ""
+	case CmdDeclareSchema:
+		return "declare_schema", c.name
+	case CmdBindSchema:
+		return "bind_schema", c.ident
+	case CmdShowSchema:
+		return "show_schema", c.name
+	case CmdCreateIndex:
+		return "create_index", c.ident + "." + c.field
+	case CmdShowDelegations:
+		return "show_delegations", c.ident
+	case CmdClearLockouts:
+		return "clear_lockouts", c.name
+	}
+	return "", ""
+}
+
+func auditDelegation(x, q string, r AccessRight, p string) string {
+	return fmt.Sprintf("%s %s %s -> %s", x, q, strings.ToLower(rightName(r)), p)
+}
+
+func auditStatus(r int) string {
+	switch r {
+	case SUCCESS:
+		return "SUCCESS"
+	case FAILED:
+		return "FAILED"
+	case DENIED:
+		return "DENIED"
+	case TERMINATED:
+		return "TERMINATED"
+	case QUOTA:
+		return "QUOTA"
+	}
+	return "N/A"
+}
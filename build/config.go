@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// server settings. the command line is fixed by the spec (port, admin
+// password), so everything else is read from the environment.
+
+var auditLogPath string // BIBIFI_AUDIT_LOG, empty = no audit log
+var pwIterations int    // BIBIFI_PW_ITERATIONS, PBKDF2 cost of new passwords
+
+var lockoutThreshold int       // BIBIFI_LOCKOUT_THRESHOLD, failures until lockout
+var lockoutRemoteThreshold int // BIBIFI_LOCKOUT_REMOTE_THRESHOLD, same per host
+var lockoutBase time.Duration  // BIBIFI_LOCKOUT_BASE, first lockout (seconds)
+var lockoutMax time.Duration   // BIBIFI_LOCKOUT_MAX, longest lockout (seconds)
+
+var sweepInterval time.Duration // BIBIFI_SWEEP_INTERVAL, expired delegations (seconds)
+var fixedClock string           // BIBIFI_CLOCK, RFC3339 time the clock is frozen at
+
+var liveDefaultDelegator bool // BIBIFI_LIVE_DEFAULT_DELEGATOR=1, initial delegator mode
+
+var maxDepth int // BIBIFI_MAX_DEPTH, nesting of records/lists in a value
+
+var maxCallDepth int // BIBIFI_MAX_CALL_DEPTH, nested procedure calls
+
+var historyVersions int // BIBIFI_HISTORY_VERSIONS, versions kept per variable
+var historyBudget int   // BIBIFI_HISTORY_BUDGET, approx. bytes of all versions
+
+func loadConfig() {
+	auditLogPath = os.Getenv("BIBIFI_AUDIT_LOG")
+	pwIterations = envInt("BIBIFI_PW_ITERATIONS", 10000, 1)
+	lockoutThreshold = envInt("BIBIFI_LOCKOUT_THRESHOLD", 5, 1)
+	lockoutRemoteThreshold = envInt("BIBIFI_LOCKOUT_REMOTE_THRESHOLD", 20, 1)
+	lockoutBase = time.Duration(envInt("BIBIFI_LOCKOUT_BASE", 1, 1)) * time.Second
+	lockoutMax = time.Duration(envInt("BIBIFI_LOCKOUT_MAX", 3600, 1)) * time.Second
+	sweepInterval = time.Duration(envInt("BIBIFI_SWEEP_INTERVAL", 60, 0)) * time.Second
+	fixedClock = os.Getenv("BIBIFI_CLOCK")
+	liveDefaultDelegator = os.Getenv("BIBIFI_LIVE_DEFAULT_DELEGATOR") == "1"
+	maxDepth = envInt("BIBIFI_MAX_DEPTH", 8, 1)
+	maxCallDepth = envInt("BIBIFI_MAX_CALL_DEPTH", 16, 1)
+	historyVersions = envInt("BIBIFI_HISTORY_VERSIONS", 10, 0)
+	historyBudget = envInt("BIBIFI_HISTORY_BUDGET", 64<<20, 0)
+}
+
+// returns the integer value of an env variable, or def if it's unset/invalid
+func envInt(name string, def, min int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < min {
+		log.Printf("Ignoring invalid %s=%s", name, v)
+		return def
+	}
+	return i
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 )
 
 const (
@@ -20,6 +23,7 @@ const (
 	VAR_MODE_SINGLE int = 0
 	VAR_MODE_RECORD int = 1
 	VAR_MODE_LIST   int = 2
+	VAR_MODE_NUMBER int = 3
 )
 
 type AccessRight byte
@@ -29,19 +33,61 @@ const (
 	WRITE    AccessRight = 2
 	APPEND   AccessRight = 4
 	DELEGATE AccessRight = 8
+	EXECUTE  AccessRight = 16 // procedures
 )
 
 type Database struct {
 	defaultDelegator string
+	liveDelegator    bool // inherit the default delegator's rights when checked
 	principals       map[string]*EntryUser         // 1:1
 	delegations      map[string][]*EntryDelegation // 1:N
+	denials          map[string][]*EntryDelegation // 1:N, override delegations
 	vars             map[string]*EntryVar          // 1:1
+	procedures       map[string]*EntryProcedure    // 1:1
+	triggers         map[string][]*EntryTrigger    // 1:N, by variable
+	indexes          map[string][]*EntryIndex      // 1:N, by variable
+	schemas          map[string]*EntrySchema       // 1:1
+	bindings         map[string]string             // variable -> schema
+}
+
+// never modified, see addTrigger
+type EntryTrigger struct {
+	varName string // KEY
+
+	body    []Cmd
+	definer string // runs as definer
+}
+
+// positions of the records in a list, by the (string) value of a field.
+// only the definition is snapshotted, see rebuildIndexes
+type EntryIndex struct {
+	varName string // KEY, w/ field
+	field   string
+
+	pos map[string][]int // ascending
+}
+
+// never modified, a new declaration replaces the entry
+type EntrySchema struct {
+	name string // KEY
+
+	fields map[string]bool // true = required
 }
 
 type EntryUser struct {
 	name string // KEY
 
-	pw string
+	salt       []byte
+	iterations int
+	pwHash     []byte // never the plaintext, see password.go
+	admin      bool   // admin role, see grantAdmin
+	readonly   bool   // can never modify state, whatever its rights
+
+	// quotas (-1 = unlimited) and usage, see chargeUsage
+	maxVars   int
+	maxBytes  int
+	usedVars  int // globals created
+	usedBytes int // string data in globals created or last written
 }
 
 type EntryDelegation struct {
@@ -50,15 +96,34 @@ type EntryDelegation struct {
 	issuerName string
 	varName    string
 	right      AccessRight
+	expires    time.Time // zero = never
+}
+
+// never modified, a new definition replaces the entry
+type EntryProcedure struct {
+	name string // KEY
+
+	params        []string
+	body          []Cmd
+	definer       string
+	definerRights bool // run as definer instead of caller
 }
 
 type EntryVar struct {
 	name string // KEY
 
-	mode        int               // 0 = direct, 1 = fields
-	value       string            // direct assignment
-	fieldValues map[string]string // multiple fields
-	list        []*EntryVar       // list
+	mode        int                  // 0 = direct, 1 = fields, 2 = list, 3 = number
+	value       string               // direct assignment
+	num         int64                // number
+	fieldValues map[string]*EntryVar // multiple fields
+	list        []*EntryVar          // list
+
+	// metadata of globals, see storeGlobalVar
+	creator    string
+	created    time.Time
+	modified   time.Time
+	modifiedBy string
+	version    int64 // 1 on creation, +1 on every write
 }
 
 func NewDatabase() *Database {
@@ -66,10 +131,18 @@ func NewDatabase() *Database {
 		defaultDelegator: USER_ANYONE,
 		principals:       make(map[string]*EntryUser, 0),
 		delegations:      make(map[string][]*EntryDelegation, 0),
+		denials:          make(map[string][]*EntryDelegation, 0),
 		vars:             make(map[string]*EntryVar, 0),
+		procedures:       make(map[string]*EntryProcedure, 0),
+		triggers:         make(map[string][]*EntryTrigger, 0),
+		indexes:          make(map[string][]*EntryIndex, 0),
+		schemas:          make(map[string]*EntrySchema, 0),
+		bindings:         make(map[string]string, 0),
 	}
 	db.defaultDelegator = USER_ANYONE
-	db.principals[USER_ADMIN] = &EntryUser{name: USER_ADMIN, pw: "admin"}
+	db.liveDelegator = liveDefaultDelegator
+	db.principals[USER_ADMIN] = NewEntryUser(USER_ADMIN, "admin")
+	db.principals[USER_ADMIN].admin = true
 	return db
 }
 
@@ -79,76 +152,130 @@ func SnapshotDatabase(env *GlobalEnv) {
 	vars := make(map[string]*EntryVar, len(env.db.vars))
 
 	for k, v := range env.db.principals {
-		principals[k] = &EntryUser{v.name, v.pw}
+		u := *v
+		principals[k] = &u
 	}
 	for k, v := range env.db.delegations {
 		delegations[k] = make([]*EntryDelegation, len(v))
 		copy(delegations[k], v)
 	}
+	denials := make(map[string][]*EntryDelegation, len(env.db.denials))
+	for k, v := range env.db.denials {
+		denials[k] = make([]*EntryDelegation, len(v))
+		copy(denials[k], v)
+	}
 	for k, v := range env.db.vars {
-		var fv map[string]string
-		var lst []*EntryVar
-		if v.mode == VAR_MODE_RECORD {
-			fv = make(map[string]string, len(v.fieldValues))
-			for fk, f := range v.fieldValues {
-				fv[fk] = f
-			}
-		} else if v.mode == VAR_MODE_LIST {
-			lst = make([]*EntryVar, len(v.list))
-			for i, l := range v.list {
-				if l.mode == VAR_MODE_RECORD {
-					fv = make(map[string]string, len(l.fieldValues))
-					for fk, f := range l.fieldValues {
-						fv[fk] = f
-					}
-				}
-				lst[i] = &EntryVar{
-					name:        "",
-					mode:        l.mode,
-					value:       l.value,
-					fieldValues: fv,
-				}
-			}
+		vars[k] = copyEntryVar(v)
+	}
+	procedures := make(map[string]*EntryProcedure, len(env.db.procedures))
+	for k, v := range env.db.procedures {
+		procedures[k] = v
+	}
+	triggers := make(map[string][]*EntryTrigger, len(env.db.triggers))
+	for k, v := range env.db.triggers {
+		triggers[k] = v
+	}
+	indexes := make(map[string][]*EntryIndex, len(env.db.indexes))
+	for k, v := range env.db.indexes {
+		for _, ix := range v {
+			indexes[k] = append(indexes[k], &EntryIndex{varName: k, field: ix.field})
 		}
-		vars[k] = &EntryVar{v.name, v.mode, v.value, fv, lst}
 	}
-	env.dbSnapshot = &Database{env.db.defaultDelegator, principals, delegations, vars}
+	schemas := make(map[string]*EntrySchema, len(env.db.schemas))
+	for k, v := range env.db.schemas {
+		schemas[k] = v
+	}
+	bindings := make(map[string]string, len(env.db.bindings))
+	for k, v := range env.db.bindings {
+		bindings[k] = v
+	}
+	env.dbSnapshot = &Database{
+		defaultDelegator: env.db.defaultDelegator,
+		liveDelegator:    env.db.liveDelegator,
+		principals:       principals,
+		delegations:      delegations,
+		denials:          denials,
+		vars:             vars,
+		procedures:       procedures,
+		triggers:         triggers,
+		indexes:          indexes,
+		schemas:          schemas,
+		bindings:         bindings,
+	}
 }
 
 func RollbackDatabase(env *GlobalEnv) {
 	env.db = env.dbSnapshot
 	env.dbSnapshot = nil
+	rebuildIndexes(env.db)
+}
+
+func NewEntryUser(name, pw string) *EntryUser {
+	u := &EntryUser{name: name, maxVars: -1, maxBytes: -1}
+	u.setPassword(pw)
+	return u
+}
+
+// deep copy
+func copyEntryVar(v *EntryVar) *EntryVar {
+	c := *v
+	if v.mode == VAR_MODE_RECORD {
+		c.fieldValues = make(map[string]*EntryVar, len(v.fieldValues))
+		for fk, f := range v.fieldValues {
+			c.fieldValues[fk] = copyEntryVar(f)
+		}
+	} else if v.mode == VAR_MODE_LIST {
+		c.list = make([]*EntryVar, len(v.list))
+		for i, l := range v.list {
+			c.list[i] = copyEntryVar(l)
+		}
+	}
+	return &c
 }
 
 func NewEntryVar(ident string, val *Value) *EntryVar {
 	var l []*EntryVar
+	var fv map[string]*EntryVar
 	if val.mode == VAR_MODE_LIST {
 		l = make([]*EntryVar, len(val.list))
 		for i, v := range val.list {
 			l[i] = NewEntryVar("", v)
 		}
+	} else if val.mode == VAR_MODE_RECORD {
+		fv = make(map[string]*EntryVar, len(val.vals))
+		for k, v := range val.vals {
+			fv[k] = NewEntryVar("", v)
+		}
 	}
 	return &EntryVar{
 		name:        ident,
 		mode:        val.mode,
 		value:       val.val,
-		fieldValues: val.vals,
+		num:         val.num,
+		fieldValues: fv,
 		list:        l,
 	}
 }
 
 func NewValue(ev *EntryVar) *Value {
 	var l []*Value
+	var vals map[string]*Value
 	if ev.mode == VAR_MODE_LIST {
 		l = make([]*Value, len(ev.list))
 		for i, v := range ev.list {
 			l[i] = NewValue(v)
 		}
+	} else if ev.mode == VAR_MODE_RECORD {
+		vals = make(map[string]*Value, len(ev.fieldValues))
+		for k, v := range ev.fieldValues {
+			vals[k] = NewValue(v)
+		}
 	}
 	return &Value{
 		mode: ev.mode,
 		val:  ev.value,
-		vals: ev.fieldValues,
+		num:  ev.num,
+		vals: vals,
 		list: l,
 	}
 }
@@ -160,24 +287,17 @@ func (env *ProgramEnv) printDB() {
 	fmt.Printf(">>> DATABASE DUMP >>>\n")
 	fmt.Printf("USERS:\n")
 	for k, v := range db.principals {
-		fmt.Printf("\t{%s: %s-%s}\n", k, v.name, v.pw)
+		fmt.Printf("\t{%s: %s}\n", k, v.name)
 	}
 	fmt.Printf("\nDELEGATIONS:\n")
 	for _, d := range db.delegations {
 		for _, v := range d {
-			right := "N/A"
-			switch v.right {
-			case READ:
-				right = "READ"
-			case WRITE:
-				right = "WRITE"
-			case APPEND:
-				right = "APPEND"
-			case DELEGATE:
-				right = "DELEGATE"
+			lifetime := ""
+			if !v.expires.IsZero() {
+				lifetime = " (" + remainingLifetime(v, env.globals.now()) + ")"
 			}
-			fmt.Printf("\t{%s %s %s -> %s}\n", v.varName, v.issuerName,
-				right, v.targetName)
+			fmt.Printf("\t{%s %s %s -> %s}%s\n", v.varName, v.issuerName,
+				rightName(v.right), v.targetName, lifetime)
 		}
 	}
 	fmt.Printf("\nGLOBALS:\n")
@@ -191,9 +311,39 @@ func (env *ProgramEnv) printDB() {
 	fmt.Printf("\n>>>>>>>>>>>>>>>>>>>>>\n")
 }
 
+// expired delegations count as absent until they are swept
+func (d *EntryDelegation) isActive(now time.Time) bool {
+	return d.expires.IsZero() || now.Before(d.expires)
+}
+
+func rightName(r AccessRight) string {
+	switch r {
+	case READ:
+		return "READ"
+	case WRITE:
+		return "WRITE"
+	case APPEND:
+		return "APPEND"
+	case DELEGATE:
+		return "DELEGATE"
+	case EXECUTE:
+		return "EXECUTE"
+	}
+	return "N/A"
+}
+
+func remainingLifetime(d *EntryDelegation, now time.Time) string {
+	if !d.isActive(now) {
+		return "expired"
+	}
+	return d.expires.Sub(now).Truncate(time.Second).String()
+}
+
 func printValue(v *EntryVar) string {
 	if v.mode == 0 {
 		return v.value
+	} else if v.mode == VAR_MODE_NUMBER {
+		return fmt.Sprintf("%d", v.num)
 	} else if v.mode == VAR_MODE_LIST {
 		s := "["
 		for i, l := range v.list {
@@ -204,7 +354,14 @@ func printValue(v *EntryVar) string {
 		}
 		return s + "]"
 	} else {
-		return fmt.Sprintf("%v", v.fieldValues)
+		s := "{"
+		for k, f := range v.fieldValues {
+			if len(s) > 1 {
+				s += ", "
+			}
+			s += k + "=" + printValue(f)
+		}
+		return s + "}"
 	}
 }
 
@@ -212,7 +369,11 @@ func printValue(v *EntryVar) string {
 
 func (db *Database) isLoginCorrect(name, pw string) bool {
 	u := db.principals[name]
-	return u != nil && u.pw == pw
+	if u == nil || name == USER_ANYONE {
+		hashPassword(pw, dummySalt, pwIterations)
+		return false
+	}
+	return u.checkPassword(pw)
 }
 
 func (db *Database) isUserExists(name string) bool {
@@ -224,16 +385,27 @@ func (db *Database) isUserExists(name string) bool {
 	return false
 }
 
-func (env *ProgramEnv) addUser(name, pw string) {
-	env.globals.db.principals[name] = &EntryUser{name: name, pw: pw}
+func (env *ProgramEnv) addUser(name, pw string, readonly bool) {
+	env.globals.db.principals[name] = NewEntryUser(name, pw)
+	env.globals.db.principals[name].readonly = readonly
+	if env.globals.db.liveDelegator {
+		// rights are inherited when checked, see rightSources
+		return
+	}
 	// give default permissions via default delegator
 	for _, r := range []AccessRight{READ, WRITE, DELEGATE, APPEND} {
 		env.setDelegationAllVars(env.globals.db.defaultDelegator, name, r)
 	}
 }
 
-func (db *Database) changePassword(name, pw string) {
-	db.principals[name].pw = pw
+// anyone has no password, so it can never log in
+func (db *Database) changePassword(name, pw string) int {
+	u, ok := db.principals[name]
+	if !ok || name == USER_ANYONE {
+		return DB_VAR_NOT_FOUND
+	}
+	u.setPassword(pw)
+	return DB_SUCCESS
 }
 
 func (env *ProgramEnv) doesUserExist(name string) bool {
@@ -241,8 +413,47 @@ func (env *ProgramEnv) doesUserExist(name string) bool {
 	return ok
 }
 
+// anyone is not a principal, but it can be delegated to and denied
+func (env *ProgramEnv) doesPrincipalExist(name string) bool {
+	return name == USER_ANYONE || env.doesUserExist(name)
+}
+
 func (db *Database) isUserAdmin(name string) bool {
-	return name == USER_ADMIN
+	u := db.principals[name]
+	return u != nil && u.admin
+}
+
+func (db *Database) isUserReadOnly(name string) bool {
+	u := db.principals[name]
+	return u != nil && u.readonly
+}
+
+func (db *Database) countAdmins() int {
+	n := 0
+	for _, u := range db.principals {
+		if u.admin {
+			n++
+		}
+	}
+	return n
+}
+
+// rights have to be checked by caller
+func (db *Database) grantAdmin(name string) {
+	u := *db.principals[name] // shared with the snapshot
+	u.admin = true
+	db.principals[name] = &u
+}
+
+// fails for the last admin, so there is always one left
+func (db *Database) revokeAdmin(name string) int {
+	if db.isUserAdmin(name) && db.countAdmins() == 1 {
+		return DB_VAR_NOT_FOUND
+	}
+	u := *db.principals[name]
+	u.admin = false
+	db.principals[name] = &u
+	return DB_SUCCESS
 }
 
 func (env *ProgramEnv) getVarValueForWith(ident, principal string,
@@ -262,6 +473,22 @@ func (env *ProgramEnv) getVarValueForWith(ident, principal string,
 	return DB_VAR_NOT_FOUND, nil
 }
 
+// the entries of a list w/ one of rs, w/o copying them (don't modify them!)
+func (env *ProgramEnv) getListEntriesForWith(ident, principal string,
+	rs ...AccessRight) (int, []*EntryVar) {
+	ev := env.getLocalVar(ident)
+	if ev == nil {
+		if !env.hasUserPrivilegeAtLeastOne(ident, principal, rs...) {
+			return DB_INSUFFICIENT_RIGHTS, nil
+		}
+		ev = env.globals.db.vars[ident]
+	}
+	if ev == nil || ev.mode != VAR_MODE_LIST {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	return DB_VAR_FOUND, ev.list
+}
+
 func (env *ProgramEnv) getLocalVar(ident string) *EntryVar {
 	return env.locals[ident]
 }
@@ -292,7 +519,13 @@ func (env *ProgramEnv) doesVarExist(ident string) bool {
 
 func (env *ProgramEnv) setVarForWith(ident string, val *Value, principal string,
 	rs ...AccessRight) int {
-	db := env.globals.db
+	return env.writeVarForWith(ident, val, 0, principal, rs...)
+}
+
+// kept is the number of leading list entries the write doesn't change (e.g.
+// appends), their index entries stay as they are
+func (env *ProgramEnv) writeVarForWith(ident string, val *Value, kept int,
+	principal string, rs ...AccessRight) int {
 	// check locals
 	if env.doesLocalVarExist(ident) {
 		env.locals[ident] = NewEntryVar(ident, val)
@@ -300,8 +533,15 @@ func (env *ProgramEnv) setVarForWith(ident string, val *Value, principal string,
 	}
 	// check if variable exists && principal has `rs` rights on it
 	if env.doesGlobalVarExist(ident) {
-		if env.hasUserPrivilegeAtLeastOne(ident, principal, rs...) {
-			db.vars[ident] = NewEntryVar(ident, val)
+		if env.hasUserPrivilegeAtLeastOne(ident, principal, rs...) ||
+			env.hasFieldWritesFor(ident, val, principal, rs...) {
+			if env.writesDeniedField(ident, val, principal) {
+				return DB_INSUFFICIENT_RIGHTS
+			}
+			if !env.matchesBoundSchema(ident, val) {
+				return DB_VAR_NOT_FOUND
+			}
+			env.storeGlobalVar(ident, val, kept, principal)
 			return DB_SUCCESS
 		} else {
 			//insufficient perms
@@ -309,10 +549,143 @@ func (env *ProgramEnv) setVarForWith(ident string, val *Value, principal string,
 		}
 	} else {
 		// otherwise, create new w/ corresponding rights
-		db.vars[ident] = NewEntryVar(ident, val)
+		owner := namespaceOwner(ident)
+		if env.doesProcedureExist(ident) || (owner != "" && !env.doesUserExist(owner)) {
+			return DB_VAR_NOT_FOUND
+		} else if owner != "" && owner != principal && !env.globals.db.isUserAdmin(principal) {
+			// only the owner (or admin) creates variables in a namespace
+			return DB_INSUFFICIENT_RIGHTS
+		}
+		env.storeGlobalVar(ident, val, 0, principal)
 		env.setDelegationAllRights(ident, principal, principal)
+		if owner != "" && owner != principal {
+			env.setDelegationAllRights(ident, owner, owner)
+		}
+		return DB_SUCCESS
+	}
+}
+
+// writes a global and keeps its metadata and indexes up to date. rights have
+// to be checked by caller.
+func (env *ProgramEnv) storeGlobalVar(ident string, val *Value, kept int,
+	principal string) {
+	db := env.globals.db
+	now := env.globals.now()
+	ev := NewEntryVar(ident, val)
+	old, ok := db.vars[ident]
+	if ok {
+		ev.creator = old.creator
+		ev.created = old.created
+		ev.version = old.version + 1
+	} else {
+		ev.creator = principal
+		ev.created = now
+		ev.version = 1
+	}
+	ev.modified = now
+	ev.modifiedBy = principal
+	check := env.quotaCheck(ev.creator, principal)
+	if ok {
+		env.chargeUsage(old, -1)
+	}
+	db.vars[ident] = ev
+	env.chargeUsage(ev, 1)
+	check()
+	env.recordOnCommit(ident)
+	env.updateIndexes(ev, kept)
+	env.queueTriggers(ident)
+}
+
+// an old version of a global w/ `r` on it: version n, or the one that was
+// current at asOf if n is 0. the current version needn't be committed yet.
+func (env *ProgramEnv) getVarVersionFor(ident string, n int64, asOf time.Time,
+	principal string, r AccessRight) (int, *Value) {
+	if env.doesLocalVarExist(ident) {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	if !env.hasUserPrivilege(ident, principal, r) {
+		return DB_INSUFFICIENT_RIGHTS, nil
+	}
+	cur, ok := env.globals.db.vars[ident]
+	if !ok {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	var ev *EntryVar
+	if n == cur.version || (n == 0 && !cur.modified.After(asOf)) {
+		ev = cur
+	} else if n != 0 {
+		ev = env.globals.history.at(ident, n)
+	} else {
+		ev = env.globals.history.asOf(ident, asOf)
+	}
+	if ev == nil {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	v := NewValue(ev)
+	if r == READ {
+		redactFields(v, env.deniedFields(ident, principal, READ))
+	}
+	return DB_VAR_FOUND, v
+}
+
+// metadata of a global w/ read on it. locals have none.
+func (env *ProgramEnv) getVarMetaFor(ident, principal string) (int, map[string]interface{}) {
+	if env.doesLocalVarExist(ident) {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	if !env.hasUserPrivilege(ident, principal, READ) {
+		return DB_INSUFFICIENT_RIGHTS, nil
+	}
+	ev, ok := env.globals.db.vars[ident]
+	if !ok {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	return DB_VAR_FOUND, map[string]interface{}{
+		"creator":     ev.creator,
+		"created":     ev.created.UTC().Format(time.RFC3339),
+		"modified":    ev.modified.UTC().Format(time.RFC3339),
+		"modified_by": ev.modifiedBy,
+		"version":     ev.version,
+	}
+}
+
+// removes a local binding, or a global w/ every delegation and denial on it
+// (and its fields). the name is free for `set`/`local` afterwards.
+func (env *ProgramEnv) deleteVarFor(ident, principal string) int {
+	if env.doesLocalVarExist(ident) {
+		env.discardLocalVar(ident)
 		return DB_SUCCESS
 	}
+	if !env.doesGlobalVarExist(ident) {
+		return DB_VAR_NOT_FOUND
+	}
+	if !env.hasUserPrivilege(ident, principal, WRITE) {
+		return DB_INSUFFICIENT_RIGHTS
+	}
+	db := env.globals.db
+	env.chargeUsage(db.vars[ident], -1)
+	delete(db.vars, ident)
+	env.recordOnCommit(ident)
+	removeRulesOn(db.delegations, ident)
+	removeRulesOn(db.denials, ident)
+	delete(db.triggers, ident)
+	delete(db.indexes, ident)
+	delete(db.bindings, ident)
+	return DB_SUCCESS
+}
+
+// drops the rules on ident and its fields (x.f). SnapshotDatabase copies the
+// rule slices, so a rollback restores them whatever is done here
+func removeRulesOn(rules map[string][]*EntryDelegation, ident string) {
+	for p, ds := range rules {
+		kept := make([]*EntryDelegation, 0, len(ds))
+		for _, d := range ds {
+			if baseVarName(d.varName) != ident {
+				kept = append(kept, d)
+			}
+		}
+		rules[p] = kept
+	}
 }
 
 func (env *ProgramEnv) doesGlobalVarExist(ident string) bool {
@@ -321,10 +694,10 @@ func (env *ProgramEnv) doesGlobalVarExist(ident string) bool {
 }
 
 func (env *ProgramEnv) getFieldValueForWith(ident, field, principal string,
-	rs ...AccessRight) (int, string) {
+	rs ...AccessRight) (int, *Value) {
 	db := env.globals.db
-	if !env.hasUserPrivilegeAtLeastOne(ident, principal, rs...) {
-		return DB_INSUFFICIENT_RIGHTS, ""
+	if !env.hasFieldPrivilegeAtLeastOne(ident, field, principal, rs...) {
+		return DB_INSUFFICIENT_RIGHTS, nil
 	}
 	var ev *EntryVar
 	var ok bool
@@ -336,21 +709,53 @@ func (env *ProgramEnv) getFieldValueForWith(ident, field, principal string,
 	}
 	if ok && ev.mode == 1 {
 		if f, ok := ev.fieldValues[field]; ok {
-			return DB_VAR_FOUND, f
+			return DB_VAR_FOUND, NewValue(f)
+		}
+	}
+	return DB_VAR_NOT_FOUND, nil
+}
+
+// assigns a field of an existing record, w/ write on the record or the
+// (top-level) field. every record on the path but the last field must exist.
+func (env *ProgramEnv) setFieldForWith(ident string, path []string, val *Value,
+	pr string) int {
+	s, rec := env.getVarValueForWith(ident, pr)
+	if s != DB_VAR_FOUND {
+		return s
+	}
+	cur := rec
+	for i, f := range path {
+		if cur.mode != VAR_MODE_RECORD {
+			return DB_VAR_NOT_FOUND
+		}
+		if i == len(path)-1 {
+			cur.vals[f] = val
+		} else if next, ok := cur.vals[f]; ok {
+			cur = next
+		} else {
+			return DB_VAR_NOT_FOUND
 		}
 	}
-	return DB_VAR_NOT_FOUND, ""
+	if tooDeep(rec) {
+		return DB_VAR_NOT_FOUND
+	}
+	// only path[0] changes, so field rights are enough
+	return env.setVarForWith(ident, rec, pr, WRITE)
 }
 
 // ident must be an existing list w/ needed rights(write, append)
 func (env *ProgramEnv) appendVarToListFor(ident string, val *Value, pr string) int {
-	if val.mode != VAR_MODE_SINGLE && val.mode != VAR_MODE_RECORD {
+	if val.mode == VAR_MODE_LIST {
 		return DB_VAR_NOT_FOUND
 	}
 	s, l := env.getVarValueForWith(ident, pr)
 	if s == DB_VAR_FOUND {
+		kept := len(l.list)
 		l.list = append(l.list, val)
-		s2 := env.setVarForWith(ident, l, pr) // we already know we have the rights
+		if tooDeep(l) {
+			return DB_VAR_NOT_FOUND
+		}
+		s2 := env.writeVarForWith(ident, l, kept, pr) // we already know we have the rights
 		return s2
 	} else {
 		return s
@@ -364,27 +769,610 @@ func (env *ProgramEnv) concatListToListFor(ident string, val *Value, pr string)
 	}
 	s, l := env.getVarValueForWith(ident, pr)
 	if s == DB_VAR_FOUND {
+		kept := len(l.list)
 		for _, item := range val.list {
 			l.list = append(l.list, item)
 		}
-		env.setVarForWith(ident, l, pr)
-		return DB_SUCCESS
+		return env.writeVarForWith(ident, l, kept, pr)
 	} else {
 		return s
 	}
 }
 
+// >>>>>>>>>>>>>>> FIELD RIGHTS >>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>
+// delegations on a single field of a record are stored like the ones on a
+// variable, with varName `x.f`. they add to the rights on the variable.
+
+func fieldRightName(ident, field string) string {
+	return ident + "." + field
+}
+
+// `x` for both `x` and `x.f`
+func baseVarName(name string) string {
+	if i := strings.Index(name, "."); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// a denial on `x.f` takes away the right on the field, even if it is
+// granted on `x`
+func (env *ProgramEnv) hasFieldPrivilegeAtLeastOne(ident, field, principal string,
+	rs ...AccessRight) bool {
+	if len(rs) == 0 || env.doesLocalVarExist(ident) {
+		return true
+	}
+	name := fieldRightName(ident, field)
+	for _, r := range rs {
+		if !env.isDenied(name, principal, r) &&
+			(env.hasUserPrivilege(name, principal, r) || env.hasUserPrivilege(ident, principal, r)) {
+			return true
+		}
+	}
+	return false
+}
+
+// the top-level fields of global ident that principal is denied `r` on by a
+// denial on `ident.f` (nil if none)
+func (env *ProgramEnv) deniedFields(ident, principal string, r AccessRight) map[string]bool {
+	if env.globals.db.isUserAdmin(principal) || isNamespaceOwner(ident, principal) ||
+		env.doesLocalVarExist(ident) {
+		return nil
+	}
+	now := env.globals.now()
+	var denied map[string]bool
+	for _, p := range []string{principal, USER_ANYONE} {
+		for _, d := range env.globals.db.denials[p] {
+			if d.right == r && d.isActive(now) && d.varName != ident &&
+				baseVarName(d.varName) == ident {
+				if denied == nil {
+					denied = make(map[string]bool, 0)
+				}
+				denied[d.varName[len(ident)+1:]] = true
+			}
+		}
+	}
+	return denied
+}
+
+// leaves out the denied fields of a record, or of the records in a list.
+// v must be a copy.
+func redactFields(v *Value, denied map[string]bool) {
+	if len(denied) == 0 {
+		return
+	}
+	if v.mode == VAR_MODE_LIST {
+		for _, e := range v.list {
+			redactFields(e, denied)
+		}
+	} else if v.mode == VAR_MODE_RECORD {
+		for f := range denied {
+			delete(v.vals, f)
+		}
+	}
+}
+
+// true if writing val to global ident changes a field of the record that
+// principal is denied write on
+func (env *ProgramEnv) writesDeniedField(ident string, val *Value, principal string) bool {
+	denied := env.deniedFields(ident, principal, WRITE)
+	ev, ok := env.globals.db.vars[ident]
+	if len(denied) == 0 || !ok || ev.mode != VAR_MODE_RECORD {
+		return false
+	}
+	old := NewValue(ev).vals
+	changed := make([]string, 0, len(old))
+	if val.mode == VAR_MODE_RECORD {
+		changed = changedFields(old, val.vals)
+	} else {
+		for f := range old {
+			changed = append(changed, f)
+		}
+	}
+	for _, f := range changed {
+		if denied[f] {
+			return true
+		}
+	}
+	return false
+}
+
+// true if principal holds right `r` on at least one field of ident
+func (env *ProgramEnv) hasAnyFieldPrivilege(ident, principal string, r AccessRight) bool {
+	now := env.globals.now()
+	for _, p := range env.rightSources(principal) {
+		for _, d := range env.globals.db.delegations[p] {
+			if d.right == r && strings.HasPrefix(d.varName, ident+".") && d.isActive(now) &&
+				env.isInherited(d, principal) && !env.isDenied(d.varName, principal, r) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// like getVarValueForWith w/ READ, but a global record can also be read
+// through field rights. the fields principal can't read are left out then.
+func (env *ProgramEnv) getReadableVarValueFor(ident, principal string) (int, *Value) {
+	s, v := env.getVarValueForWith(ident, principal, READ)
+	if s == DB_VAR_FOUND {
+		redactFields(v, env.deniedFields(ident, principal, READ))
+	}
+	if s != DB_INSUFFICIENT_RIGHTS {
+		return s, v
+	}
+	ev, ok := env.globals.db.vars[ident]
+	if !ok || ev.mode != VAR_MODE_RECORD || !env.hasAnyFieldPrivilege(ident, principal, READ) {
+		return DB_INSUFFICIENT_RIGHTS, nil
+	}
+	fields := make(map[string]*Value, 0)
+	for k, f := range ev.fieldValues {
+		if env.hasUserPrivilege(fieldRightName(ident, k), principal, READ) {
+			fields[k] = NewValue(f)
+		}
+	}
+	return DB_VAR_FOUND, &Value{mode: VAR_MODE_RECORD, vals: fields}
+}
+
+// a record may be overwritten w/o write on the variable, if principal
+// has write on every field that changes (and at least one field)
+func (env *ProgramEnv) hasFieldWritesFor(ident string, val *Value, principal string,
+	rs ...AccessRight) bool {
+	ev, ok := env.globals.db.vars[ident]
+	if !ok || ev.mode != VAR_MODE_RECORD || val.mode != VAR_MODE_RECORD {
+		return false
+	}
+	for _, r := range rs {
+		if r != WRITE || !env.hasAnyFieldPrivilege(ident, principal, WRITE) {
+			continue
+		}
+		allowed := true
+		for _, k := range changedFields(NewValue(ev).vals, val.vals) {
+			if !env.hasUserPrivilege(fieldRightName(ident, k), principal, WRITE) {
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// fields that are added, removed or modified
+func changedFields(old, new map[string]*Value) []string {
+	changed := make([]string, 0)
+	for k, v := range old {
+		if nv, ok := new[k]; !ok || !valuesEqual(nv, v) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range new {
+		if _, ok := old[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	return changed
+}
+
+// >>>>>>>>>>>>>>> QUOTAS >>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>
+// a global counts for its creator, its string data for the creator and the
+// principal that wrote it last. usage is kept in EntryUser, so a rollback
+// restores it. exceeding a quota marks the program (see overQuota), which
+// is then rolled back.
+
+func stringBytes(ev *EntryVar) int {
+	n := len(ev.value)
+	for _, f := range ev.fieldValues {
+		n += stringBytes(f)
+	}
+	for _, l := range ev.list {
+		n += stringBytes(l)
+	}
+	return n
+}
+
+// adds (sign 1) or removes (sign -1) a global from the usage
+func (env *ProgramEnv) chargeUsage(ev *EntryVar, sign int) {
+	db := env.globals.db
+	bytes := sign * stringBytes(ev)
+	if u, ok := db.principals[ev.creator]; ok {
+		u.usedVars += sign
+		u.usedBytes += bytes
+	}
+	if ev.modifiedBy != ev.creator {
+		if u, ok := db.principals[ev.modifiedBy]; ok {
+			u.usedBytes += bytes
+		}
+	}
+}
+
+// remembers the usage of principals, the returned func marks the program
+// if a write made it grow above a quota. usage that shrinks is fine, so a
+// principal above a (lowered) quota can still clean up.
+func (env *ProgramEnv) quotaCheck(names ...string) func() {
+	type usage struct{ vars, bytes int }
+	db := env.globals.db
+	before := make(map[string]usage, len(names))
+	for _, n := range names {
+		if u, ok := db.principals[n]; ok {
+			before[n] = usage{u.usedVars, u.usedBytes}
+		}
+	}
+	return func() {
+		for n, b := range before {
+			u := db.principals[n]
+			if (u.maxVars >= 0 && u.usedVars > u.maxVars && u.usedVars > b.vars) ||
+				(u.maxBytes >= 0 && u.usedBytes > u.maxBytes && u.usedBytes > b.bytes) {
+				env.overQuota = true
+			}
+		}
+	}
+}
+
+// -1 = unlimited, nil = unchanged
+func (db *Database) setQuota(name string, maxVars, maxBytes *int) int {
+	u, ok := db.principals[name]
+	if !ok {
+		return DB_VAR_NOT_FOUND
+	}
+	if maxVars != nil {
+		u.maxVars = *maxVars
+	}
+	if maxBytes != nil {
+		u.maxBytes = *maxBytes
+	}
+	return DB_SUCCESS
+}
+
+func (db *Database) getQuota(name string) (int, map[string]interface{}) {
+	u, ok := db.principals[name]
+	if !ok {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	q := map[string]interface{}{"vars": u.usedVars, "bytes": u.usedBytes}
+	if u.maxVars >= 0 {
+		q["max_vars"] = u.maxVars
+	}
+	if u.maxBytes >= 0 {
+		q["max_bytes"] = u.maxBytes
+	}
+	return DB_SUCCESS, q
+}
+
+// >>>>>>>>>>>>>>> PROCEDURES >>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>
+// procedures share the names of globals, so the delegation commands work on
+// both. EXECUTE is the right to call one.
+
+func (env *ProgramEnv) doesProcedureExist(name string) bool {
+	_, ok := env.globals.db.procedures[name]
+	return ok
+}
+
+// a global (or its field) or a procedure
+func (env *ProgramEnv) isDelegatable(name string) bool {
+	return env.doesGlobalVarExist(baseVarName(name)) || env.doesProcedureExist(name)
+}
+
+// admins only, checked by caller. replaces an existing definition.
+func (env *ProgramEnv) defineProcedure(proc *EntryProcedure) int {
+	if env.doesVarExist(proc.name) {
+		return DB_VAR_NOT_FOUND
+	}
+	env.globals.db.procedures[proc.name] = proc
+	return DB_SUCCESS
+}
+
+func (env *ProgramEnv) getProcedureFor(name, principal string) (int, *EntryProcedure) {
+	proc, ok := env.globals.db.procedures[name]
+	if !ok {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	if !env.hasUserPrivilege(name, principal, EXECUTE) {
+		return DB_INSUFFICIENT_RIGHTS, nil
+	}
+	return DB_VAR_FOUND, proc
+}
+
+// >>>>>>>>>>>>>>> TRIGGERS >>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>
+// run after every command that wrote their variable, see fireTriggers
+
+// admins only, checked by caller. builds a new slice, the snapshot of the db
+// shares the old one
+func (env *ProgramEnv) addTrigger(t *EntryTrigger) int {
+	if !env.doesGlobalVarExist(t.varName) {
+		return DB_VAR_NOT_FOUND
+	}
+	db := env.globals.db
+	ts := make([]*EntryTrigger, 0, len(db.triggers[t.varName])+1)
+	db.triggers[t.varName] = append(append(ts, db.triggers[t.varName]...), t)
+	return DB_SUCCESS
+}
+
+// once per command, in the order of the writes
+func (env *ProgramEnv) queueTriggers(ident string) {
+	if len(env.globals.db.triggers[ident]) == 0 {
+		return
+	}
+	for _, name := range env.triggered {
+		if name == ident {
+			return
+		}
+	}
+	env.triggered = append(env.triggered, ident)
+}
+
+// >>>>>>>>>>>>>>> INDEXES >>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>
+// maintained on every write of their variable (see storeGlobalVar) and used
+// by the equality conditions of `select`. records whose field isn't a string
+// aren't indexed.
+
+// indexes the entries of ev from position `from` on
+func (ix *EntryIndex) add(ev *EntryVar, from int) {
+	if ev == nil || ev.mode != VAR_MODE_LIST {
+		return
+	}
+	for i := from; i < len(ev.list); i++ {
+		e := ev.list[i]
+		if e.mode != VAR_MODE_RECORD {
+			continue
+		}
+		if f, ok := e.fieldValues[ix.field]; ok && f.mode == VAR_MODE_SINGLE {
+			ix.pos[f.value] = append(ix.pos[f.value], i)
+		}
+	}
+}
+
+func (ix *EntryIndex) build(ev *EntryVar) {
+	ix.pos = make(map[string][]int, 0)
+	ix.add(ev, 0)
+}
+
+// after a rollback, or when loading a database
+func rebuildIndexes(db *Database) {
+	for name, ixs := range db.indexes {
+		for _, ix := range ixs {
+			ix.build(db.vars[name])
+		}
+	}
+}
+
+func (env *ProgramEnv) updateIndexes(ev *EntryVar, kept int) {
+	for _, ix := range env.globals.db.indexes[ev.name] {
+		if kept == 0 {
+			ix.build(ev)
+		} else {
+			ix.add(ev, kept)
+		}
+	}
+}
+
+// admins only, checked by caller. an existing index is kept
+func (env *ProgramEnv) createIndex(ident, field string) int {
+	db := env.globals.db
+	if !env.doesGlobalVarExist(ident) {
+		return DB_VAR_NOT_FOUND
+	}
+	for _, ix := range db.indexes[ident] {
+		if ix.field == field {
+			return DB_SUCCESS
+		}
+	}
+	ix := &EntryIndex{varName: ident, field: field}
+	ix.build(db.vars[ident])
+	db.indexes[ident] = append(db.indexes[ident], ix)
+	return DB_SUCCESS
+}
+
+// positions of the records in global ident whose field is val, if the field
+// is indexed. rights have to be checked by caller.
+func (env *ProgramEnv) lookupIndex(ident, field, val string) ([]int, bool) {
+	if env.doesLocalVarExist(ident) {
+		return nil, false
+	}
+	for _, ix := range env.globals.db.indexes[ident] {
+		if ix.field == field {
+			return ix.pos[val], true
+		}
+	}
+	return nil, false
+}
+
+// every index, compared against a full scan of its variable
+func (env *ProgramEnv) checkIndexes() []map[string]interface{} {
+	db := env.globals.db
+	names := make([]string, 0, len(db.indexes))
+	for name := range db.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make([]map[string]interface{}, 0)
+	for _, name := range names {
+		for _, ix := range db.indexes[name] {
+			scan := &EntryIndex{varName: name, field: ix.field}
+			scan.build(db.vars[name])
+			res = append(res, map[string]interface{}{
+				"variable":   name,
+				"field":      ix.field,
+				"keys":       len(ix.pos),
+				"consistent": samePositions(ix.pos, scan.pos),
+			})
+		}
+	}
+	return res
+}
+
+func samePositions(a, b map[string][]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, pa := range a {
+		pb, ok := b[k]
+		if !ok || len(pa) != len(pb) {
+			return false
+		}
+		for i := range pa {
+			if pa[i] != pb[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// >>>>>>>>>>>>>>> SCHEMAS >>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>
+// a global bound to a schema is a record, or a list of records, w/ every
+// required field of the schema and no other fields. checked on every write,
+// see writeVarForWith.
+
+func (sc *EntrySchema) matches(val *Value) bool {
+	switch val.mode {
+	case VAR_MODE_LIST:
+		for _, e := range val.list {
+			if e.mode != VAR_MODE_RECORD || !sc.matchesRecord(e) {
+				return false
+			}
+		}
+		return true
+	case VAR_MODE_RECORD:
+		return sc.matchesRecord(val)
+	}
+	return false
+}
+
+func (sc *EntrySchema) matchesRecord(rec *Value) bool {
+	for f := range rec.vals {
+		if _, ok := sc.fields[f]; !ok {
+			return false
+		}
+	}
+	for f, required := range sc.fields {
+		if _, ok := rec.vals[f]; required && !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (env *ProgramEnv) matchesBoundSchema(ident string, val *Value) bool {
+	db := env.globals.db
+	name, ok := db.bindings[ident]
+	return !ok || db.schemas[name].matches(val)
+}
+
+// admins only, checked by caller. a new declaration of a schema must match
+// the variables bound to it
+func (env *ProgramEnv) declareSchema(sc *EntrySchema) int {
+	db := env.globals.db
+	for v, name := range db.bindings {
+		if name == sc.name && !sc.matches(NewValue(db.vars[v])) {
+			return DB_VAR_NOT_FOUND
+		}
+	}
+	db.schemas[sc.name] = sc
+	return DB_SUCCESS
+}
+
+// admins only, checked by caller. replaces an existing binding of ident
+func (env *ProgramEnv) bindSchema(name, ident string) int {
+	db := env.globals.db
+	sc, ok := db.schemas[name]
+	if !ok || !env.doesGlobalVarExist(ident) || !sc.matches(NewValue(db.vars[ident])) {
+		return DB_VAR_NOT_FOUND
+	}
+	db.bindings[ident] = name
+	return DB_SUCCESS
+}
+
+// the fields of a schema and the variables bound to it that principal can read
+func (env *ProgramEnv) describeSchema(name, principal string) (int, map[string]interface{}) {
+	db := env.globals.db
+	sc, ok := db.schemas[name]
+	if !ok {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	required, optional := make([]string, 0), make([]string, 0)
+	for f, req := range sc.fields {
+		if req {
+			required = append(required, f)
+		} else {
+			optional = append(optional, f)
+		}
+	}
+	bound := make([]string, 0)
+	for v, n := range db.bindings {
+		if n == name && env.hasUserPrivilege(v, principal, READ) {
+			bound = append(bound, v)
+		}
+	}
+	sort.Strings(required)
+	sort.Strings(optional)
+	sort.Strings(bound)
+	return DB_VAR_FOUND, map[string]interface{}{
+		"required": required,
+		"optional": optional,
+		"bound_to": bound,
+	}
+}
+
+// >>>>>>>>>>>>>>> NAMESPACES >>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>
+// `alice::x` lives in the namespace of alice, who has every right on it
+// (and its fields), whatever delegations or denials say. unqualified names
+// are plain globals.
+
+func isQualified(ident string) bool {
+	return strings.Contains(ident, "::")
+}
+
+// "" for unqualified names
+func namespaceOwner(varName string) string {
+	if i := strings.Index(varName, "::"); i >= 0 {
+		return varName[:i]
+	}
+	return ""
+}
+
+func isNamespaceOwner(varName, principal string) bool {
+	owner := namespaceOwner(baseVarName(varName))
+	return owner != "" && owner == principal
+}
+
 // >>>>>>>>>>>>>>> DELEGATION ASSERTIONS >>>>>>>>>>>>>>>>>>>>>>>>>>
 
 func (env *ProgramEnv) setDefaultDelegator(target string) {
 	// rights have to be checked by caller.
-	// TODO: implement logic for this..
 	env.globals.db.defaultDelegator = target
 }
 
+// in live mode every principal has the rights of the current default
+// delegator. otherwise they are copied once, when a principal is created.
+func (env *ProgramEnv) setLiveDelegator(live bool) {
+	env.globals.db.liveDelegator = live
+}
+
+// principals whose delegations count for principal: itself, anyone and,
+// in live mode, the default delegator
+func (env *ProgramEnv) rightSources(principal string) []string {
+	db := env.globals.db
+	sources := []string{principal, USER_ANYONE}
+	if db.liveDelegator && db.defaultDelegator != principal &&
+		db.defaultDelegator != USER_ANYONE {
+		sources = append(sources, db.defaultDelegator)
+	}
+	return sources
+}
+
+// finds a delegation regardless of its expiry
 func (env *ProgramEnv) getDelegationIndex(varName, issuer, target string,
 		r AccessRight) (int, bool) {
-	if delegs, ok := env.globals.db.delegations[target]; ok {
+	return getRuleIndex(env.globals.db.delegations, varName, issuer, target, r)
+}
+
+// finds a delegation or denial in `rules`
+func getRuleIndex(rules map[string][]*EntryDelegation, varName, issuer,
+		target string, r AccessRight) (int, bool) {
+	if delegs, ok := rules[target]; ok {
 		for i, d := range delegs {
 			if d.issuerName == issuer && d.varName == varName && d.right == r {
 				return i, true
@@ -397,6 +1385,26 @@ func (env *ProgramEnv) getDelegationIndex(varName, issuer, target string,
 
 func (env *ProgramEnv) setDelegation(varName, issuer, target string,
 		r AccessRight) int {
+	return env.setDelegationUntil(varName, issuer, target, r, time.Time{})
+}
+
+// like setDelegation, but the delegation ends at `expires` (zero = never)
+func (env *ProgramEnv) setDelegationUntil(varName, issuer, target string,
+		r AccessRight, expires time.Time) int {
+	return env.setRuleUntil(env.globals.db.delegations, varName, issuer, target,
+		r, expires)
+}
+
+// a denial takes the right away from target, whatever it was granted
+func (env *ProgramEnv) setDenialUntil(varName, issuer, target string,
+		r AccessRight, expires time.Time) int {
+	return env.setRuleUntil(env.globals.db.denials, varName, issuer, target,
+		r, expires)
+}
+
+// adds a delegation or denial to `rules`
+func (env *ProgramEnv) setRuleUntil(rules map[string][]*EntryDelegation,
+		varName, issuer, target string, r AccessRight, expires time.Time) int {
 	db := env.globals.db
 
 	if env.globals.db.isUserAdmin(target) {
@@ -404,29 +1412,18 @@ func (env *ProgramEnv) setDelegation(varName, issuer, target string,
 	}
 
 	// Fail #1: if either p or q does not exist
-	_, issuerExists := db.principals[issuer]
-	_, targetExists := db.principals[target]
-
-	if !issuerExists || !targetExists {
+	if !env.doesPrincipalExist(issuer) || !env.doesPrincipalExist(target) {
 		return DB_VAR_NOT_FOUND
 	}
 
-	// Fail #2 x does not exist or is local var
-	if !env.doesGlobalVarExist(varName) {
+	// Fail #2 x does not exist or is local var (x may be a field `x.f`)
+	if !env.isDelegatable(varName) {
 		return DB_VAR_NOT_FOUND
 	}
 
 	// Fail #3: if q does not have delegate permission on varName
-	hasDelegRight := false
-	if delegs, ok := db.delegations[issuer]; ok {
-		for _, d := range delegs {
-			if d.varName == varName && d.right == DELEGATE {
-				hasDelegRight = true
-				break
-			}
-		}
-	}
-	if !db.isUserAdmin(env.principal) && !(env.principal == issuer) && !hasDelegRight {
+	if !db.isUserAdmin(env.principal) && !(env.principal == issuer) &&
+		!env.hasDelegateRight(varName, issuer) {
 		return DB_INSUFFICIENT_RIGHTS
 	}
 
@@ -435,16 +1432,41 @@ func (env *ProgramEnv) setDelegation(varName, issuer, target string,
 		issuerName: issuer,
 		varName:    varName,
 		right:      r,
+		expires:    expires,
 	}
 	// check if this delegation already exists:
-	_, exist := env.getDelegationIndex(varName, issuer, target, r)
+	i, exist := getRuleIndex(rules, varName, issuer, target, r)
 	if !exist {
-		db.delegations[target] = append(db.delegations[target], &entryDelegation)
+		rules[target] = append(rules[target], &entryDelegation)
+	} else {
+		// renew (or end) its lifetime. entries are shared with the snapshot,
+		// so replace instead of modifying it
+		rules[target][i] = &entryDelegation
 	}
 
 	return DB_SUCCESS
 }
 
+// delegating a field needs delegate on the field or variable
+func (env *ProgramEnv) hasDelegateRight(varName, issuer string) bool {
+	if isNamespaceOwner(varName, issuer) {
+		return true
+	}
+	now := env.globals.now()
+	for _, p := range env.rightSources(issuer) {
+		if p == USER_ANYONE && issuer != USER_ANYONE {
+			continue
+		}
+		for _, d := range env.globals.db.delegations[p] {
+			if (d.varName == varName || d.varName == baseVarName(varName)) &&
+				d.right == DELEGATE && d.isActive(now) && env.isInherited(d, issuer) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (env *ProgramEnv) setDelegationAllRights(varName, issuer, target string) int {
 	//TODO make more efficient lol
 	for _, r := range []AccessRight{READ, WRITE, APPEND, DELEGATE} {
@@ -455,6 +1477,20 @@ func (env *ProgramEnv) setDelegationAllRights(varName, issuer, target string) in
 
 func (env *ProgramEnv) deleteDelegation(varName, issuer, target string,
 	r AccessRight) int {
+	// a principal may always give up its own rights
+	return env.deleteRule(env.globals.db.delegations, varName, issuer, target,
+		r, true)
+}
+
+func (env *ProgramEnv) deleteDenial(varName, issuer, target string,
+	r AccessRight) int {
+	// ..but not lift its own denials
+	return env.deleteRule(env.globals.db.denials, varName, issuer, target,
+		r, false)
+}
+
+func (env *ProgramEnv) deleteRule(rules map[string][]*EntryDelegation,
+	varName, issuer, target string, r AccessRight, targetMayDelete bool) int {
 	db := env.globals.db
 
 	if env.globals.db.isUserAdmin(target) {
@@ -462,36 +1498,24 @@ func (env *ProgramEnv) deleteDelegation(varName, issuer, target string,
 	}
 
 	// Fail #1: if either p or q does not exist
-	_, issuerExists := db.principals[issuer]
-	_, targetExists := db.principals[target]
-
-	if !issuerExists || !targetExists {
+	if !env.doesPrincipalExist(issuer) || !env.doesPrincipalExist(target) {
 		return DB_VAR_NOT_FOUND
 	}
 
-	// Fail #2 x does not exist or is local var
-	if !env.doesGlobalVarExist(varName) {
+	// Fail #2 x does not exist or is local var (x may be a field `x.f`)
+	if !env.isDelegatable(varName) {
 		return DB_VAR_NOT_FOUND
 	}
 
 	// Fail #3: if q does not have delegate permission on varName
-	hasDelegRight := false
-	if delegs, ok := db.delegations[issuer]; ok {
-		for _, d := range delegs {
-			if d.varName == varName && d.right == DELEGATE {
-				hasDelegRight = true
-				break
-			}
-		}
-	}
-	if !(env.principal == target) && !db.isUserAdmin(env.principal) && !hasDelegRight {
+	if !(targetMayDelete && env.principal == target) &&
+		!db.isUserAdmin(env.principal) && !env.hasDelegateRight(varName, issuer) {
 		return DB_INSUFFICIENT_RIGHTS
 	}
 
-	i, ok := env.getDelegationIndex(varName, issuer, target, r)
+	i, ok := getRuleIndex(rules, varName, issuer, target, r)
 	if ok {
-		db.delegations[target] = append(db.delegations[target][:i],
-			db.delegations[target][i+1:]...)
+		rules[target] = append(rules[target][:i], rules[target][i+1:]...)
 		return DB_SUCCESS
 	}
 	// not found, return success still, lol
@@ -500,17 +1524,16 @@ func (env *ProgramEnv) deleteDelegation(varName, issuer, target string,
 
 func (env *ProgramEnv) setDelegationAllVars(issuer, target string, r AccessRight) int {
 	// get all vars where ISSUER has right `r` on
-	vars := make([]string, 0)
-	if delegs, ok := env.globals.db.delegations[issuer]; ok {
-		for _, d := range delegs {
-			if d.right == r {
-				vars = append(vars, d.varName)
-			}
+	now := env.globals.now()
+	delegs := make([]*EntryDelegation, 0)
+	for _, d := range env.globals.db.delegations[issuer] {
+		if d.right == r && d.isActive(now) {
+			delegs = append(delegs, d)
 		}
 	}
-	// add those to `target`
-	for _, v := range vars {
-		s := env.setDelegation(v, issuer, target, r)
+	// add those to `target`, they expire along with the issuer's
+	for _, d := range delegs {
+		s := env.setDelegationUntil(d.varName, issuer, target, r, d.expires)
 		if s != DB_SUCCESS {
 			return s
 		}
@@ -548,17 +1571,20 @@ func (env *ProgramEnv) hasUserPrivilegeAtLeastOne(varName, principal string,
 	if rs == nil || len(rs) == 0 {
 		return true
 	}
-	if env.globals.db.isUserAdmin(principal) || env.doesLocalVarExist(varName) {
+	if env.globals.db.isUserAdmin(principal) || env.doesLocalVarExist(varName) ||
+		isNamespaceOwner(varName, principal) {
 		return true
 	}
-	for _,p := range []string{principal, USER_ANYONE} {
+	now := env.globals.now()
+	for _,p := range env.rightSources(principal) {
 		if delegs, ok := env.globals.db.delegations[p]; ok {
 			// loop all delegation statements for that principal
 			for _, deleg := range delegs {
-				if deleg.varName == varName {
+				if deleg.varName == varName && deleg.isActive(now) &&
+					env.isInherited(deleg, principal) {
 					// loop all possible rights
 					for _, r := range rs {
-						if deleg.right == r {
+						if deleg.right == r && !env.isDenied(varName, principal, r) {
 							return true
 						}
 					}
@@ -568,3 +1594,135 @@ func (env *ProgramEnv) hasUserPrivilegeAtLeastOne(varName, principal string,
 	}
 	return false
 }
+
+// a right the default delegator is denied isn't passed on
+func (env *ProgramEnv) isInherited(deleg *EntryDelegation, principal string) bool {
+	t := deleg.targetName
+	return t == principal || t == USER_ANYONE || !env.isDenied(deleg.varName, t, deleg.right)
+}
+
+// a denial on `x` also covers its fields `x.f`
+func (env *ProgramEnv) isDenied(varName, principal string, r AccessRight) bool {
+	if env.globals.db.isUserAdmin(principal) || isNamespaceOwner(varName, principal) {
+		return false
+	}
+	now := env.globals.now()
+	for _, p := range []string{principal, USER_ANYONE} {
+		for _, d := range env.globals.db.denials[p] {
+			if d.right == r && d.isActive(now) &&
+				(d.varName == varName || d.varName == baseVarName(varName)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the denials that take a delegation away (from some principals, if it's
+// a delegation to anyone)
+func (env *ProgramEnv) getDenialsOf(deleg *EntryDelegation) []*EntryDelegation {
+	now := env.globals.now()
+	denials := make([]*EntryDelegation, 0)
+	for p, ds := range env.globals.db.denials {
+		if p != deleg.targetName && p != USER_ANYONE && deleg.targetName != USER_ANYONE {
+			continue
+		}
+		for _, d := range ds {
+			if d.right == deleg.right && d.isActive(now) &&
+				(d.varName == deleg.varName || d.varName == baseVarName(deleg.varName)) {
+				denials = append(denials, d)
+			}
+		}
+	}
+	sort.Slice(denials, func(i, j int) bool {
+		if denials[i].targetName != denials[j].targetName {
+			return denials[i].targetName < denials[j].targetName
+		}
+		return denials[i].issuerName < denials[j].issuerName
+	})
+	return denials
+}
+
+// active delegations and denials on varName and its fields.
+// a delegation lists the denials that take it away in `denied_by`.
+func (env *ProgramEnv) listDelegations(varName string) []map[string]interface{} {
+	l := make([]map[string]interface{}, 0)
+	for _, d := range env.getRulesOn(env.globals.db.delegations, varName) {
+		item := env.describeRule(d, varName)
+		if denials := env.getDenialsOf(d); len(denials) > 0 {
+			by := make([]map[string]interface{}, len(denials))
+			for i, dn := range denials {
+				by[i] = env.describeRule(dn, varName)
+			}
+			item["denied_by"] = by
+		}
+		l = append(l, item)
+	}
+	for _, d := range env.getRulesOn(env.globals.db.denials, varName) {
+		item := env.describeRule(d, varName)
+		item["denial"] = true
+		l = append(l, item)
+	}
+	return l
+}
+
+// active rules on varName and its fields, ordered by field, target,
+// issuer and right
+func (env *ProgramEnv) getRulesOn(rules map[string][]*EntryDelegation,
+	varName string) []*EntryDelegation {
+	now := env.globals.now()
+	delegs := make([]*EntryDelegation, 0)
+	for _, ds := range rules {
+		for _, d := range ds {
+			if baseVarName(d.varName) == varName && d.isActive(now) {
+				delegs = append(delegs, d)
+			}
+		}
+	}
+	sort.Slice(delegs, func(i, j int) bool {
+		a, b := delegs[i], delegs[j]
+		if a.varName != b.varName {
+			return a.varName < b.varName
+		} else if a.targetName != b.targetName {
+			return a.targetName < b.targetName
+		} else if a.issuerName != b.issuerName {
+			return a.issuerName < b.issuerName
+		}
+		return a.right < b.right
+	})
+	return delegs
+}
+
+func (env *ProgramEnv) describeRule(d *EntryDelegation,
+	varName string) map[string]interface{} {
+	item := map[string]interface{}{
+		"issuer": d.issuerName,
+		"right":  strings.ToLower(rightName(d.right)),
+		"target": d.targetName,
+	}
+	if d.varName != varName {
+		item["field"] = d.varName[len(varName)+1:]
+	}
+	if !d.expires.IsZero() {
+		item["expires"] = d.expires.UTC().Format(time.RFC3339)
+		item["remaining"] = remainingLifetime(d, env.globals.now())
+	}
+	return item
+}
+
+// drops all delegations and denials that have expired
+func (db *Database) sweepExpiredDelegations(now time.Time) {
+	for _, rules := range []map[string][]*EntryDelegation{db.delegations, db.denials} {
+		for target, delegs := range rules {
+			active := make([]*EntryDelegation, 0, len(delegs))
+			for _, d := range delegs {
+				if d.isActive(now) {
+					active = append(active, d)
+				}
+			}
+			if len(active) < len(delegs) {
+				rules[target] = active
+			}
+		}
+	}
+}
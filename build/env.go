@@ -1,28 +1,84 @@
 package main
 
+import (
+	"time"
+)
+
 type GlobalEnv struct {
 	db *Database
 	dbSnapshot *Database
+	audit *AuditLog
+	logins *LoginGuard
+	history *History // committed versions of the globals
+	clock func() time.Time // injectable for tests
+	lastSweep time.Time
 }
 
 type ProgramEnv struct {
 	principal string
 	pw string
+	remote string
+	readonly bool // only read-only commands, see isReadOnlyCmd
 	globals *GlobalEnv
 	locals map[string]*EntryVar
 	results []Result
 	status_code int
+	audit []AuditEntry
+	onCommit []func() // run once the program is committed
+	written map[string]bool // globals whose history is updated on commit
+	overQuota bool // a write exceeded a quota, the program is rolled back
+	callDepth int // nested procedure calls
+	args map[string]string // string arguments of the running procedure
+	triggered []string // globals written by the current command w/ triggers
+}
+
+// inside a procedure, a principal name that is one of its params stands for
+// the (string) argument, e.g. `create principal p pw`
+func (env *ProgramEnv) principalArg(name string) string {
+	if arg, ok := env.args[name]; ok {
+		return arg
+	}
+	return name
 }
 
 func NewGlobalEnv() *GlobalEnv {
-	return &GlobalEnv{db: NewDatabase()}
+	return &GlobalEnv{db: NewDatabase(), logins: NewLoginGuard(),
+		history: NewHistory(), clock: time.Now}
+}
+
+func (ge *GlobalEnv) now() time.Time {
+	return ge.clock()
 }
 
-func NewProgramEnv(ge *GlobalEnv) *ProgramEnv {
+// removes expired delegations, at most once per sweep interval
+func (ge *GlobalEnv) sweep() {
+	now := ge.now()
+	if now.Sub(ge.lastSweep) < sweepInterval {
+		return
+	}
+	ge.db.sweepExpiredDelegations(now)
+	ge.lastSweep = now
+}
+
+func NewProgramEnv(ge *GlobalEnv, remote string) *ProgramEnv {
 	return &ProgramEnv{
 		globals: ge,
+		remote: remote,
 		locals: make(map[string]*EntryVar, 0),
 		results: make([]Result, 0),
 		status_code: -1,
+		written: make(map[string]bool, 0),
+	}
+}
+
+// the committed state of a written/deleted global goes into the history
+func (env *ProgramEnv) recordOnCommit(ident string) {
+	if env.written[ident] {
+		return
 	}
+	env.written[ident] = true
+	ge := env.globals
+	env.onCommit = append(env.onCommit, func() {
+		ge.history.record(ident, ge.db.vars[ident])
+	})
 }
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -8,6 +13,7 @@ const (
 	FAILED = 1
 	DENIED = 2
 	TERMINATED = 3
+	QUOTA = 4
 )
 
 type Result struct {
@@ -18,15 +24,26 @@ type Result struct {
 type Value struct {
 	mode int
 	val string
-	vals map[string]string
+	num int64
+	vals map[string]*Value
 	list []*Value
 }
 
+// results of comparisons, the same as the ones of equal/notequal
+var TRUE_VALUE = &Value{mode: VAR_MODE_SINGLE, val: ""}
+var FALSE_VALUE = &Value{mode: VAR_MODE_SINGLE, val: "0"}
+
 func formatOutput(v *Value) interface{} {
 	if v.mode == 0 {
 		return v.val
+	} else if v.mode == VAR_MODE_NUMBER {
+		return v.num
 	} else if v.mode == VAR_MODE_RECORD {
-		return v.vals
+		rec := make(map[string]interface{}, len(v.vals))
+		for k, f := range v.vals {
+			rec[k] = formatOutput(f)
+		}
+		return rec
 	} else {
 		list := make([]interface{},0)
 		for _,l := range v.list {
@@ -37,6 +54,110 @@ func formatOutput(v *Value) interface{} {
 	}
 }
 
+// nesting of records and lists, a string or number has depth 0
+func valueDepth(v *Value) int {
+	d := 0
+	if v.mode == VAR_MODE_RECORD {
+		for _, f := range v.vals {
+			if fd := valueDepth(f); fd > d {
+				d = fd
+			}
+		}
+		return d + 1
+	} else if v.mode == VAR_MODE_LIST {
+		for _, l := range v.list {
+			if ld := valueDepth(l); ld > d {
+				d = ld
+			}
+		}
+		return d + 1
+	}
+	return 0
+}
+
+func tooDeep(v *Value) bool {
+	return valueDepth(v) > maxDepth
+}
+
+func valuesEqual(a, b *Value) bool {
+	if a.mode != b.mode {
+		return false
+	}
+	switch a.mode {
+	case VAR_MODE_SINGLE:
+		return a.val == b.val
+	case VAR_MODE_NUMBER:
+		return a.num == b.num
+	case VAR_MODE_RECORD:
+		if len(a.vals) != len(b.vals) {
+			return false
+		}
+		for k, f := range a.vals {
+			if g, ok := b.vals[k]; !ok || !valuesEqual(f, g) {
+				return false
+			}
+		}
+		return true
+	default:
+		if len(a.list) != len(b.list) {
+			return false
+		}
+		for i := range a.list {
+			if !valuesEqual(a.list[i], b.list[i]) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// order of `sort`: numbers < strings < records < lists. numbers compare
+// numerically, strings bytewise, records and lists are all equal (they
+// keep their order, as the sort is stable).
+func sortRank(v *Value) int {
+	switch v.mode {
+	case VAR_MODE_NUMBER:
+		return 0
+	case VAR_MODE_SINGLE:
+		return 1
+	case VAR_MODE_RECORD:
+		return 2
+	}
+	return 3
+}
+
+// -1, 0 or 1
+func compareValues(a, b *Value) int {
+	ra, rb := sortRank(a), sortRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+	switch a.mode {
+	case VAR_MODE_NUMBER:
+		if a.num < b.num {
+			return -1
+		} else if a.num > b.num {
+			return 1
+		}
+	case VAR_MODE_SINGLE:
+		return strings.Compare(a.val, b.val)
+	}
+	return 0
+}
+
+// the sort key of v, nil if v is not a record or lacks the field
+func sortKey(v *Value, field string) *Value {
+	if field == "" {
+		return v
+	} else if v.mode != VAR_MODE_RECORD {
+		return nil
+	}
+	return v.vals[field]
+}
+
 func (val ExprString) eval(env *ProgramEnv) (int, *Value) {
 	return DB_VAR_FOUND, &Value{mode:0, val: val.val}
 }
@@ -44,13 +165,122 @@ func (val ExprString) eval(env *ProgramEnv) (int, *Value) {
 func (val ExprFieldAcc) eval(env *ProgramEnv) (int, *Value) {
 	s, v := env.getFieldValueForWith(val.ident, val.field, env.principal, READ)
 	if s == DB_VAR_FOUND {
-		return DB_VAR_FOUND, &Value{mode:0, val: v}
+		return DB_VAR_FOUND, v
 	}
 	return s, nil
 }
 
+func (val ExprNumber) eval(env *ProgramEnv) (int, *Value) {
+	return DB_VAR_FOUND, &Value{mode: VAR_MODE_NUMBER, num: val.num}
+}
+
+// evaluates both operands of a binary function
+func evalOperands(env *ProgramEnv, a, b Expr) (int, *Value, *Value) {
+	s, x := a.eval(env)
+	if s != DB_VAR_FOUND {
+		return s, nil, nil
+	}
+	s, y := b.eval(env)
+	if s != DB_VAR_FOUND {
+		return s, nil, nil
+	}
+	return DB_VAR_FOUND, x, y
+}
+
+func (expr ExprArith) eval(env *ProgramEnv) (int, *Value) {
+	s, x, y := evalOperands(env, expr.a, expr.b)
+	if s != DB_VAR_FOUND {
+		return s, nil
+	} else if x.mode != VAR_MODE_NUMBER || y.mode != VAR_MODE_NUMBER {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	a, b := x.num, y.num
+	var r int64
+	switch expr.op {
+	case "add":
+		r = a + b
+		// overflow iff both operands have the same sign and the result not
+		if (a >= 0) == (b >= 0) && (r >= 0) != (a >= 0) {
+			return DB_VAR_NOT_FOUND, nil
+		}
+	case "sub":
+		r = a - b
+		if (a >= 0) != (b >= 0) && (r >= 0) != (a >= 0) {
+			return DB_VAR_NOT_FOUND, nil
+		}
+	case "mul":
+		r = a * b
+		if a != 0 && (r/a != b || (a == -1 && b == math.MinInt64)) {
+			return DB_VAR_NOT_FOUND, nil
+		}
+	}
+	return DB_VAR_FOUND, &Value{mode: VAR_MODE_NUMBER, num: r}
+}
+
+func (expr ExprCompare) eval(env *ProgramEnv) (int, *Value) {
+	s, x, y := evalOperands(env, expr.a, expr.b)
+	if s != DB_VAR_FOUND {
+		return s, nil
+	}
+	var r bool
+	switch expr.op {
+	case "equal":
+		r = valuesEqual(x, y)
+	case "notequal":
+		r = !valuesEqual(x, y)
+	default:
+		// ordering is only defined on numbers
+		if x.mode != VAR_MODE_NUMBER || y.mode != VAR_MODE_NUMBER {
+			return DB_VAR_NOT_FOUND, nil
+		}
+		switch expr.op {
+		case "lt":
+			r = x.num < y.num
+		case "le":
+			r = x.num <= y.num
+		case "gt":
+			r = x.num > y.num
+		case "ge":
+			r = x.num >= y.num
+		}
+	}
+	if r {
+		return DB_VAR_FOUND, TRUE_VALUE
+	}
+	return DB_VAR_FOUND, FALSE_VALUE
+}
+
+func (expr ExprToNum) eval(env *ProgramEnv) (int, *Value) {
+	s, v := expr.expr.eval(env)
+	if s != DB_VAR_FOUND {
+		return s, nil
+	} else if v.mode == VAR_MODE_NUMBER {
+		return DB_VAR_FOUND, v
+	} else if v.mode != VAR_MODE_SINGLE {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	n, err := strconv.ParseInt(v.val, 10, 64)
+	if err != nil {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	return DB_VAR_FOUND, &Value{mode: VAR_MODE_NUMBER, num: n}
+}
+
+func (val ExprField) eval(env *ProgramEnv) (int, *Value) {
+	s, rec := val.rec.eval(env)
+	if s != DB_VAR_FOUND {
+		return s, nil
+	} else if rec.mode != VAR_MODE_RECORD {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	if f, ok := rec.vals[val.field]; ok {
+		return DB_VAR_FOUND, f
+	}
+	return DB_VAR_NOT_FOUND, nil
+}
+
 func (val ExprIdent) eval(env *ProgramEnv) (int, *Value) {
-	s, v := env.getVarValueForWith(val.ident, env.principal, READ)
+	s, v := env.getReadableVarValueFor(val.ident, env.principal)
 	if s == DB_VAR_FOUND {
 		return DB_VAR_FOUND, v
 	}
@@ -61,8 +291,169 @@ func (expr ExprEmptyList) eval(env *ProgramEnv) (int, *Value) {
 	return DB_VAR_FOUND, &Value{mode: VAR_MODE_LIST, list: make([]*Value, 0)}
 }
 
+// the entries of a list operand. a variable isn't copied (x[i] in a loop
+// over a big x), so only copy the entries returned, see entryValue
+func evalList(env *ProgramEnv, expr Expr) (int, []*EntryVar) {
+	if id, ok := expr.(ExprIdent); ok {
+		return env.getListEntriesForWith(id.ident, env.principal, READ)
+	}
+	s, l := expr.eval(env)
+	if s != DB_VAR_FOUND {
+		return s, nil
+	} else if l.mode != VAR_MODE_LIST {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	entries := make([]*EntryVar, len(l.list))
+	for i, v := range l.list {
+		entries[i] = NewEntryVar("", v)
+	}
+	return DB_VAR_FOUND, entries
+}
+
+// a copy of an entry of evalList, w/o the fields denied like reading the list
+func entryValue(env *ProgramEnv, list Expr, e *EntryVar) *Value {
+	v := NewValue(e)
+	if id, ok := list.(ExprIdent); ok {
+		redactFields(v, env.deniedFields(id.ident, env.principal, READ))
+	}
+	return v
+}
+
+// position in a list of length n, negative positions count from the end.
+// the result may still be out of range.
+func evalPos(env *ProgramEnv, n int, pos Expr) (int, int64) {
+	s, i := pos.eval(env)
+	if s != DB_VAR_FOUND {
+		return s, 0
+	} else if i.mode != VAR_MODE_NUMBER {
+		return DB_VAR_NOT_FOUND, 0
+	}
+	if i.num < 0 {
+		return DB_VAR_FOUND, i.num + int64(n)
+	}
+	return DB_VAR_FOUND, i.num
+}
+
+func (expr ExprIndex) eval(env *ProgramEnv) (int, *Value) {
+	s, l := evalList(env, expr.list)
+	if s != DB_VAR_FOUND {
+		return s, nil
+	}
+	s, i := evalPos(env, len(l), expr.index)
+	if s != DB_VAR_FOUND {
+		return s, nil
+	} else if i < 0 || i >= int64(len(l)) {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	return DB_VAR_FOUND, entryValue(env, expr.list, l[i])
+}
+
+func (expr ExprSlice) eval(env *ProgramEnv) (int, *Value) {
+	s, l := evalList(env, expr.list)
+	if s != DB_VAR_FOUND {
+		return s, nil
+	}
+	from, to := int64(0), int64(len(l))
+	if expr.from != nil {
+		if s, from = evalPos(env, len(l), expr.from); s != DB_VAR_FOUND {
+			return s, nil
+		}
+	}
+	if expr.to != nil {
+		if s, to = evalPos(env, len(l), expr.to); s != DB_VAR_FOUND {
+			return s, nil
+		}
+	}
+	if from < 0 || from > to || to > int64(len(l)) {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	sl := make([]*Value, 0, to-from)
+	for _, e := range l[from:to] {
+		sl = append(sl, entryValue(env, expr.list, e))
+	}
+	return DB_VAR_FOUND, &Value{mode: VAR_MODE_LIST, list: sl}
+}
+
+func (expr ExprLen) eval(env *ProgramEnv) (int, *Value) {
+	s, l := evalList(env, expr.expr)
+	if s != DB_VAR_FOUND {
+		return s, nil
+	}
+	return DB_VAR_FOUND, &Value{mode: VAR_MODE_NUMBER, num: int64(len(l))}
+}
+
+// only the matching entries are copied, it runs on big lists
+func (expr ExprSelect) eval(env *ProgramEnv) (int, *Value) {
+	want := make([]string, len(expr.where))
+	for i, c := range expr.where {
+		s, v := c.val.eval(env)
+		if s != DB_VAR_FOUND {
+			return s, nil
+		} else if v.mode != VAR_MODE_SINGLE {
+			return DB_VAR_NOT_FOUND, nil
+		}
+		want[i] = v.val
+	}
+	s, entries := env.getListEntriesForWith(expr.ident, env.principal, READ)
+	if s != DB_VAR_FOUND {
+		return s, nil
+	}
+	// denied fields can't be returned, nor filtered on
+	denied := env.deniedFields(expr.ident, env.principal, READ)
+	for _, c := range expr.where {
+		if denied[c.field] {
+			return DB_INSUFFICIENT_RIGHTS, nil
+		}
+	}
+	// only the entries an index lists need to be checked
+	for i, c := range expr.where {
+		if pos, ok := env.lookupIndex(expr.ident, c.field, want[i]); ok {
+			indexed := make([]*EntryVar, len(pos))
+			for j, p := range pos {
+				indexed[j] = entries[p]
+			}
+			entries = indexed
+			break
+		}
+	}
+	res := make([]*Value, 0)
+	for _, e := range entries {
+		if !matchesWhere(e, expr.where, want) {
+			continue
+		}
+		if expr.fields == nil {
+			v := NewValue(e)
+			redactFields(v, denied)
+			res = append(res, v)
+			continue
+		}
+		vals := make(map[string]*Value, len(expr.fields))
+		for _, f := range expr.fields {
+			if fv, ok := e.fieldValues[f]; ok && !denied[f] {
+				vals[f] = NewValue(fv)
+			}
+		}
+		res = append(res, &Value{mode: VAR_MODE_RECORD, vals: vals})
+	}
+	return DB_VAR_FOUND, &Value{mode: VAR_MODE_LIST, list: res}
+}
+
+// exact string equality, entries that aren't records never match
+func matchesWhere(e *EntryVar, where []SelectCond, want []string) bool {
+	if e.mode != VAR_MODE_RECORD {
+		return false
+	}
+	for i, c := range where {
+		fv, ok := e.fieldValues[c.field]
+		if !ok || fv.mode != VAR_MODE_SINGLE || fv.value != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (expr ExprRecord) eval(env *ProgramEnv) (int, *Value) {
-	f := make(map[string]string,0)
+	f := make(map[string]*Value,0)
 	for k, vals := range expr.fields {
 		// check if key already exists
 		if _, ok := f[k]; ok {
@@ -72,24 +463,381 @@ func (expr ExprRecord) eval(env *ProgramEnv) (int, *Value) {
 		s, v := vals.eval(env)
 		if s != DB_VAR_FOUND {
 			return s, nil
-		} else if v.mode == VAR_MODE_SINGLE {
-			// must evaluate to string
-			f[k] = v.val
 		} else {
-			return DB_VAR_NOT_FOUND, nil
+			f[k] = v
 		}
 	}
-	return DB_VAR_FOUND, &Value{mode: VAR_MODE_RECORD, vals: f}
+	rec := &Value{mode: VAR_MODE_RECORD, vals: f}
+	if tooDeep(rec) {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	return DB_VAR_FOUND, rec
+}
+
+func (expr ExprMerge) eval(env *ProgramEnv) (int, *Value) {
+	s, rec := expr.rec.eval(env)
+	if s != DB_VAR_FOUND {
+		return s, nil
+	} else if rec.mode != VAR_MODE_RECORD {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	s, with := expr.with.eval(env)
+	if s != DB_VAR_FOUND {
+		return s, nil
+	}
+	f := make(map[string]*Value, len(rec.vals)+len(with.vals))
+	for k, v := range rec.vals {
+		f[k] = v
+	}
+	for k, v := range with.vals {
+		f[k] = v
+	}
+	merged := &Value{mode: VAR_MODE_RECORD, vals: f}
+	if tooDeep(merged) {
+		return DB_VAR_NOT_FOUND, nil
+	}
+	return DB_VAR_FOUND, merged
 }
 
 func (p Program) execute(env *ProgramEnv) int {
-	for _,cmd := range p.cmds {
-		r := cmd.execute(env)
+	if r := env.executeCmds(p.cmds); r != SUCCESS {
+		return r
+	}
+	return FAILED // didn't terminate..
+}
+
+// runs cmds until one doesn't succeed
+func (env *ProgramEnv) executeCmds(cmds []Cmd) int {
+	for _,cmd := range cmds {
+		var r int
+		if env.readonly && !isReadOnlyCmd(cmd) {
+			// refused before anything is evaluated
+			env.results = []Result{ Result{Status: "DENIED"} }
+			r = DENIED
+		} else {
+			r = cmd.execute(env)
+		}
+		if r == SUCCESS {
+			r = env.fireTriggers()
+		}
+		if env.overQuota {
+			// the program is rolled back, whatever the command returned
+			env.results = []Result{ Result{Status: "QUOTA"} }
+			r = QUOTA
+		}
+		env.recordAudit(cmd, r)
 		if r != SUCCESS {
 			return r
 		}
 	}
-	return FAILED // didn't terminate..
+	return SUCCESS
+}
+
+// runs the triggers on the globals the last command wrote, as their definers
+// and w/o results of their own. a failing trigger fails the command.
+func (env *ProgramEnv) fireTriggers() int {
+	written := env.triggered
+	env.triggered = nil
+	for _, name := range written {
+		for _, t := range env.globals.db.triggers[name] {
+			if env.callDepth >= maxCallDepth {
+				env.results = []Result{ Result{Status: "FAILED"} }
+				return FAILED
+			}
+			callerLocals, callerArgs, caller := env.locals, env.args, env.principal
+			env.locals, env.args = make(map[string]*EntryVar, 0), nil
+			env.principal = t.definer
+			n := len(env.results)
+			env.callDepth++
+			r := env.executeCmds(t.body)
+			env.callDepth--
+			env.locals, env.args, env.principal = callerLocals, callerArgs, caller
+			if r != SUCCESS {
+				return r
+			}
+			env.results = env.results[:n]
+		}
+	}
+	return SUCCESS
+}
+
+// true is "", like the result of equal
+func (cmd CmdIf) execute(env *ProgramEnv) int {
+	s, v := cmd.cond.eval(env)
+	if s == DB_INSUFFICIENT_RIGHTS {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	} else if s != DB_VAR_FOUND {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+	if v.mode == VAR_MODE_SINGLE && v.val == "" {
+		return env.executeCmds(cmd.then)
+	}
+	return env.executeCmds(cmd.els)
+}
+
+func (cmd CmdDefineProc) execute(env *ProgramEnv) int {
+	if !env.globals.db.isUserAdmin(env.principal) {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	}
+	s := env.defineProcedure(&EntryProcedure{
+		name: cmd.name,
+		params: cmd.params,
+		body: cmd.body,
+		definer: env.principal,
+		definerRights: cmd.definerRights,
+	})
+	if s != DB_SUCCESS {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+	env.results = append(env.results, Result{Status: "DEFINE_PROCEDURE"})
+	return SUCCESS
+}
+
+// the body runs w/ the params as its only locals, as the caller (or the
+// definer), inside the calling program
+func (cmd CmdCall) execute(env *ProgramEnv) int {
+	s, proc := env.getProcedureFor(cmd.name, env.principal)
+	if s == DB_INSUFFICIENT_RIGHTS {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	} else if s != DB_VAR_FOUND || len(cmd.args) != len(proc.params) ||
+		env.callDepth >= maxCallDepth {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+	locals := make(map[string]*EntryVar, len(proc.params))
+	args := make(map[string]string, len(proc.params))
+	for i, arg := range cmd.args {
+		s, v := arg.eval(env)
+		if s == DB_INSUFFICIENT_RIGHTS {
+			env.results = []Result{ Result{Status: "DENIED"} }
+			return DENIED
+		} else if s != DB_VAR_FOUND {
+			env.results = []Result{ Result{Status: "FAILED"} }
+			return FAILED
+		}
+		locals[proc.params[i]] = NewEntryVar(proc.params[i], v)
+		if v.mode == VAR_MODE_SINGLE {
+			args[proc.params[i]] = v.val
+		}
+	}
+
+	callerLocals, callerArgs, caller := env.locals, env.args, env.principal
+	env.locals, env.args = locals, args
+	if proc.definerRights {
+		env.principal = proc.definer
+	}
+	env.callDepth++
+	r := env.executeCmds(proc.body)
+	env.callDepth--
+	env.locals, env.args, env.principal = callerLocals, callerArgs, caller
+	if r != SUCCESS {
+		return r
+	}
+	env.results = append(env.results, Result{Status: "CALL"})
+	return SUCCESS
+}
+
+func (cmd CmdOnWrite) execute(env *ProgramEnv) int {
+	if !env.globals.db.isUserAdmin(env.principal) {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	}
+	s := env.addTrigger(&EntryTrigger{
+		varName: cmd.ident,
+		body: cmd.body,
+		definer: env.principal,
+	})
+	if s != DB_SUCCESS {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+	env.results = append(env.results, Result{Status: "ON_WRITE"})
+	return SUCCESS
+}
+
+func (cmd CmdReject) execute(env *ProgramEnv) int {
+	env.results = []Result{ Result{Status: "FAILED"} }
+	return FAILED
+}
+
+func (cmd CmdBlock) execute(env *ProgramEnv) int {
+	// never part of a parsed program
+	env.results = []Result{ Result{Status: "FAILED"} }
+	return FAILED
+}
+
+// the commands allowed for read-only principals and sessions
+func isReadOnlyCmd(cmd Cmd) bool {
+	switch cmd.(type) {
+	case CmdAsPrincipal, CmdComment, CmdIf, CmdCall, CmdReject, CmdReturn, CmdReturnMeta, CmdReturnVersion,
+		CmdLocal,
+		CmdShowDelegations, CmdShowIndexes, CmdShowLockouts, CmdShowQuota,
+		CmdShowSchema:
+		return true
+	}
+	return false
+}
+
+func (cmd CmdReturnMeta) execute(env *ProgramEnv) int {
+	s, meta := env.getVarMetaFor(cmd.ident, env.principal)
+	if s == DB_VAR_FOUND {
+		env.results = append(env.results, Result{
+			Status: "RETURNING",
+			Output: meta,
+		})
+		return TERMINATED
+	} else if s == DB_INSUFFICIENT_RIGHTS {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	} else {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+}
+
+func (cmd CmdReturnVersion) execute(env *ProgramEnv) int {
+	s, v := env.getVarVersionFor(cmd.ident, cmd.version, cmd.asOf, env.principal, READ)
+	if s == DB_VAR_FOUND {
+		env.results = append(env.results, Result{
+			Status: "RETURNING",
+			Output: formatOutput(v),
+		})
+		return TERMINATED
+	} else if s == DB_INSUFFICIENT_RIGHTS {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	} else {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+}
+
+func (cmd CmdRevert) execute(env *ProgramEnv) int {
+	s, v := env.getVarVersionFor(cmd.ident, cmd.version, time.Time{}, env.principal, WRITE)
+	if s == DB_VAR_FOUND {
+		// a new version w/ the old value
+		s = env.setVarForWith(cmd.ident, v, env.principal, WRITE)
+	}
+	if s == DB_SUCCESS {
+		env.results = append(env.results, Result{Status: "REVERT"})
+		return SUCCESS
+	} else if s == DB_INSUFFICIENT_RIGHTS {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	} else {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+}
+
+func (cmd CmdSetHistory) execute(env *ProgramEnv) int {
+	if !env.doesGlobalVarExist(cmd.ident) {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	} else if !env.hasUserPrivilege(cmd.ident, env.principal, DELEGATE) {
+		// writers mustn't be able to erase the history
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	}
+	ident, limit, h := cmd.ident, cmd.limit, env.globals.history
+	env.onCommit = append(env.onCommit, func() {
+		h.setLimit(ident, limit)
+	})
+	env.results = append(env.results, Result{Status: "SET_HISTORY"})
+	return SUCCESS
+}
+
+func (cmd CmdSetQuota) execute(env *ProgramEnv) int {
+	if !env.globals.db.isUserAdmin(env.principal) {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	}
+	if env.globals.db.setQuota(cmd.p, cmd.maxVars, cmd.maxBytes) != DB_SUCCESS {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+	env.results = append(env.results, Result{Status: "SET_QUOTA"})
+	return SUCCESS
+}
+
+func (cmd CmdShowQuota) execute(env *ProgramEnv) int {
+	if cmd.p != env.principal && !env.globals.db.isUserAdmin(env.principal) {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	}
+	s, q := env.globals.db.getQuota(cmd.p)
+	if s != DB_SUCCESS {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+	env.results = append(env.results, Result{Status: "SHOW_QUOTA", Output: q})
+	return SUCCESS
+}
+
+func (cmd CmdCreateIndex) execute(env *ProgramEnv) int {
+	if !env.globals.db.isUserAdmin(env.principal) {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	}
+	if env.createIndex(cmd.ident, cmd.field) != DB_SUCCESS {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+	env.results = append(env.results, Result{Status: "CREATE_INDEX"})
+	return SUCCESS
+}
+
+func (cmd CmdShowIndexes) execute(env *ProgramEnv) int {
+	if !env.globals.db.isUserAdmin(env.principal) {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	}
+	env.results = append(env.results, Result{
+		Status: "SHOW_INDEXES",
+		Output: env.checkIndexes(),
+	})
+	return SUCCESS
+}
+
+func (cmd CmdDeclareSchema) execute(env *ProgramEnv) int {
+	if !env.globals.db.isUserAdmin(env.principal) {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	}
+	if env.declareSchema(&EntrySchema{name: cmd.name, fields: cmd.fields}) != DB_SUCCESS {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+	env.results = append(env.results, Result{Status: "DECLARE_SCHEMA"})
+	return SUCCESS
+}
+
+func (cmd CmdBindSchema) execute(env *ProgramEnv) int {
+	if !env.globals.db.isUserAdmin(env.principal) {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	}
+	if env.bindSchema(cmd.name, cmd.ident) != DB_SUCCESS {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+	env.results = append(env.results, Result{Status: "BIND_SCHEMA"})
+	return SUCCESS
+}
+
+func (cmd CmdShowSchema) execute(env *ProgramEnv) int {
+	s, sc := env.describeSchema(cmd.name, env.principal)
+	if s != DB_VAR_FOUND {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+	env.results = append(env.results, Result{Status: "SHOW_SCHEMA", Output: sc})
+	return SUCCESS
 }
 
 func (cmd CmdExit) execute(env *ProgramEnv) int {
@@ -124,9 +872,21 @@ func (cmd CmdComment) execute(env *ProgramEnv) int {
 func (cmd CmdAsPrincipal) execute(env *ProgramEnv) int {
 	env.principal = cmd.principal
 	env.pw = cmd.pw
-	if env.globals.db.isLoginCorrect(env.principal, env.pw) {
+	// the password is checked even when locked out, so a lockout can't
+	// be told apart from a wrong password (neither by result nor by time)
+	now := env.globals.now()
+	host := remoteHost(env.remote)
+	locked := env.globals.logins.isLocked(env.principal, host, now)
+	correct := env.globals.db.isLoginCorrect(env.principal, env.pw)
+	if correct && !locked {
+		env.globals.logins.succeeded(env.principal)
+		env.readonly = cmd.readonly || env.globals.db.isUserReadOnly(env.principal)
 		return SUCCESS
 	} else {
+		if !correct {
+			env.globals.logins.failed(env.principal,
+				env.doesUserExist(env.principal), host, now)
+		}
 		env.results = []Result{ Result{Status: "DENIED"} }
 		return DENIED
 	}
@@ -135,7 +895,12 @@ func (cmd CmdAsPrincipal) execute(env *ProgramEnv) int {
 func (cmd CmdSet) execute(env *ProgramEnv) int {
 	s, val := cmd.expr.eval(env)
 	if s == DB_VAR_FOUND {
-		set := env.setVarForWith(cmd.ident, val, env.principal, WRITE)
+		var set int
+		if len(cmd.path) > 0 {
+			set = env.setFieldForWith(cmd.ident, cmd.path, val, env.principal)
+		} else {
+			set = env.setVarForWith(cmd.ident, val, env.principal, WRITE)
+		}
 		if set == DB_SUCCESS {
 			env.results = append(env.results, Result{Status: "SET"})
 			return SUCCESS
@@ -156,7 +921,16 @@ func (cmd CmdSet) execute(env *ProgramEnv) int {
 }
 
 func (cmd CmdCreatePr) execute(env *ProgramEnv) int {
-	if env.doesUserExist(cmd.principal) {
+	principal, pw := env.principalArg(cmd.principal), cmd.pw
+	if cmd.pwArg != "" {
+		var ok bool
+		if pw, ok = env.args[cmd.pwArg]; !ok {
+			env.results = []Result{ Result{Status: "FAILED"} }
+			return FAILED
+		}
+	}
+	if !isValidIdentifier(principal) || isQualified(principal) ||
+		env.doesUserExist(principal) {
 		env.results = []Result{ Result{Status: "FAILED"} }
 		return FAILED
 	}
@@ -164,7 +938,7 @@ func (cmd CmdCreatePr) execute(env *ProgramEnv) int {
 		env.results = []Result{ Result{Status: "DENIED"} }
 		return DENIED
 	}
-	env.addUser(cmd.principal, cmd.pw)
+	env.addUser(principal, pw, cmd.readonly)
 	env.results = append(env.results, Result{Status: "CREATE_PRINCIPAL"})
 	return SUCCESS
 }
@@ -175,7 +949,10 @@ func (cmd CmdChangePw) execute(env *ProgramEnv) int {
 		return FAILED
 	}
 	if env.globals.db.isUserAdmin(env.principal) || env.principal == cmd.principal {
-		env.globals.db.changePassword(cmd.principal, cmd.pw)
+		if env.globals.db.changePassword(cmd.principal, cmd.pw) != DB_SUCCESS {
+			env.results = []Result{ Result{Status: "FAILED"} }
+			return FAILED
+		}
 		env.results = append(env.results, Result{Status: "CHANGE_PASSWORD"})
 		return SUCCESS
 	} else {
@@ -207,6 +984,20 @@ func (cmd CmdLocal) execute(env *ProgramEnv) int {
 	}
 }
 
+func (cmd CmdDeleteVar) execute(env *ProgramEnv) int {
+	s := env.deleteVarFor(cmd.ident, env.principal)
+	if s == DB_SUCCESS {
+		env.results = append(env.results, Result{Status: "DELETE_VAR"})
+		return SUCCESS
+	} else if s == DB_INSUFFICIENT_RIGHTS {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	} else {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+}
+
 func (cmd CmdAppend) execute(env *ProgramEnv) int {
 	s, exprVal := cmd.expr.eval(env)
 	if s == DB_VAR_FOUND {
@@ -216,6 +1007,7 @@ func (cmd CmdAppend) execute(env *ProgramEnv) int {
 			var ret int
 			switch exprVal.mode {
 				case VAR_MODE_SINGLE: fallthrough
+				case VAR_MODE_NUMBER: fallthrough
 				case VAR_MODE_RECORD: // append
 					ret = env.appendVarToListFor(cmd.ident, exprVal, env.principal)
 				case VAR_MODE_LIST: // concat
@@ -247,6 +1039,46 @@ func (cmd CmdAppend) execute(env *ProgramEnv) int {
 	}
 }
 
+func (cmd CmdSort) execute(env *ProgramEnv) int {
+	// the list is read and written back, so both rights are needed
+	if !env.hasUserPrivilege(cmd.ident, env.principal, READ) ||
+		!env.hasUserPrivilege(cmd.ident, env.principal, WRITE) {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	}
+	sl, l := env.getVarValueForWith(cmd.ident, env.principal, READ)
+	if sl == DB_VAR_FOUND && l.mode == VAR_MODE_LIST {
+		sort.SliceStable(l.list, func(i, j int) bool {
+			a, b := sortKey(l.list[i], cmd.field), sortKey(l.list[j], cmd.field)
+			if a == nil || b == nil {
+				// entries w/o the field go last, in any direction
+				return a != nil
+			}
+			if cmd.desc {
+				return compareValues(a, b) > 0
+			}
+			return compareValues(a, b) < 0
+		})
+		set := env.setVarForWith(cmd.ident, l, env.principal, WRITE)
+		if set == DB_SUCCESS {
+			env.results = append(env.results, Result{Status: "SORT"})
+			return SUCCESS
+		} else if set == DB_INSUFFICIENT_RIGHTS {
+			env.results = []Result{ Result{Status: "DENIED"} }
+			return DENIED
+		} else {
+			env.results = []Result{ Result{Status: "FAILED"} }
+			return FAILED
+		}
+	} else if sl == DB_INSUFFICIENT_RIGHTS {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	} else {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+}
+
 func (cmd CmdForeach) execute(env *ProgramEnv) int {
 	// check if local var already exists
 	if env.doesVarExist(cmd.identE) {
@@ -277,8 +1109,15 @@ func (cmd CmdForeach) execute(env *ProgramEnv) int {
 			// discard tmp local variable
 			env.discardLocalVar(cmd.identE)
 		}
-		// write new list in old location
-		env.setVarForWith(cmd.identL, newList, env.principal) // must succeed
+		if tooDeep(newList) {
+			env.results = []Result{ Result{Status: "FAILED"} }
+			return FAILED
+		}
+		// write new list in old location, fails if it breaks a bound schema
+		if env.setVarForWith(cmd.identL, newList, env.principal) != DB_SUCCESS {
+			env.results = []Result{ Result{Status: "FAILED"} }
+			return FAILED
+		}
 		env.results = append(env.results, Result{Status: "FOREACH"})
 		return SUCCESS
 	} else if sl == DB_INSUFFICIENT_RIGHTS {
@@ -291,11 +1130,16 @@ func (cmd CmdForeach) execute(env *ProgramEnv) int {
 }
 
 func (cmd CmdSetDeleg) execute(env *ProgramEnv) int {
-	if !env.doesUserExist(cmd.q) || !env.doesUserExist(cmd.q) {
+	q, p := env.principalArg(cmd.q), env.principalArg(cmd.p)
+	if !env.doesPrincipalExist(q) || !env.doesPrincipalExist(q) {
 		env.results = []Result{ Result{Status: "FAILED"} }
 		return FAILED
 	}
-	s := env.setDelegation(cmd.tgt, cmd.q, cmd.p, cmd.right)
+	expires := cmd.until
+	if cmd.lifetime != 0 {
+		expires = env.globals.now().Add(cmd.lifetime)
+	}
+	s := env.setDelegationUntil(cmd.tgt, q, p, cmd.right, expires)
 	switch s {
 	case DB_SUCCESS:
 		env.results = append(env.results, Result{Status: "SET_DELEGATION"})
@@ -309,11 +1153,12 @@ func (cmd CmdSetDeleg) execute(env *ProgramEnv) int {
 	}
 }
 func (cmd CmdDeleteDeleg) execute(env *ProgramEnv) int {
-	if !env.doesUserExist(cmd.q) || !env.doesUserExist(cmd.q) {
+	q, p := env.principalArg(cmd.q), env.principalArg(cmd.p)
+	if !env.doesPrincipalExist(q) || !env.doesPrincipalExist(q) {
 		env.results = []Result{ Result{Status: "FAILED"} }
 		return FAILED
 	}
-	s := env.deleteDelegation(cmd.tgt, cmd.q, cmd.p, cmd.right)
+	s := env.deleteDelegation(cmd.tgt, q, p, cmd.right)
 	switch s {
 	case DB_SUCCESS:
 		env.results = append(env.results, Result{Status: "DELETE_DELEGATION"})
@@ -327,6 +1172,50 @@ func (cmd CmdDeleteDeleg) execute(env *ProgramEnv) int {
 	}
 }
 
+func (cmd CmdSetDenial) execute(env *ProgramEnv) int {
+	q, p := env.principalArg(cmd.q), env.principalArg(cmd.p)
+	if !env.doesPrincipalExist(q) || !env.doesPrincipalExist(p) {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+	expires := cmd.until
+	if cmd.lifetime != 0 {
+		expires = env.globals.now().Add(cmd.lifetime)
+	}
+	s := env.setDenialUntil(cmd.tgt, q, p, cmd.right, expires)
+	switch s {
+	case DB_SUCCESS:
+		env.results = append(env.results, Result{Status: "SET_DENIAL"})
+		return SUCCESS
+	case DB_INSUFFICIENT_RIGHTS:
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	default:
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+}
+
+func (cmd CmdDeleteDenial) execute(env *ProgramEnv) int {
+	q, p := env.principalArg(cmd.q), env.principalArg(cmd.p)
+	if !env.doesPrincipalExist(q) || !env.doesPrincipalExist(p) {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+	s := env.deleteDenial(cmd.tgt, q, p, cmd.right)
+	switch s {
+	case DB_SUCCESS:
+		env.results = append(env.results, Result{Status: "DELETE_DENIAL"})
+		return SUCCESS
+	case DB_INSUFFICIENT_RIGHTS:
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	default:
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+}
+
 func (cmd CmdDefaultDeleg) execute(env *ProgramEnv) int {
 	if !env.doesUserExist(cmd.p) {
 		env.results = []Result{ Result{Status: "FAILED"} }
@@ -336,8 +1225,83 @@ func (cmd CmdDefaultDeleg) execute(env *ProgramEnv) int {
 		return DENIED
 	}
 	env.setDefaultDelegator(cmd.p)
+	if cmd.setMode {
+		env.setLiveDelegator(cmd.live)
+	}
 	env.results = append(env.results, Result{Status: "DEFAULT_DELEGATOR"})
 	return SUCCESS
 }
 
+func (cmd CmdGrantAdmin) execute(env *ProgramEnv) int {
+	if !env.doesUserExist(cmd.p) || cmd.p == USER_ANYONE {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	} else if !env.globals.db.isUserAdmin(env.principal) {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	}
+	env.globals.db.grantAdmin(cmd.p)
+	env.results = append(env.results, Result{Status: "GRANT_ADMIN"})
+	return SUCCESS
+}
+
+func (cmd CmdRevokeAdmin) execute(env *ProgramEnv) int {
+	if !env.doesUserExist(cmd.p) {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	} else if !env.globals.db.isUserAdmin(env.principal) {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	}
+	if env.globals.db.revokeAdmin(cmd.p) != DB_SUCCESS {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+	env.results = append(env.results, Result{Status: "REVOKE_ADMIN"})
+	return SUCCESS
+}
+
+func (cmd CmdShowLockouts) execute(env *ProgramEnv) int {
+	if !env.globals.db.isUserAdmin(env.principal) {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	}
+	env.results = append(env.results, Result{
+		Status: "SHOW_LOCKOUTS",
+		Output: env.globals.logins.list(env.globals.now()),
+	})
+	return SUCCESS
+}
+
+// lists the active delegations on a variable, for admins and principals
+// allowed to delegate it
+func (cmd CmdShowDelegations) execute(env *ProgramEnv) int {
+	if !env.isDelegatable(cmd.ident) {
+		env.results = []Result{ Result{Status: "FAILED"} }
+		return FAILED
+	}
+	if !env.hasUserPrivilege(cmd.ident, env.principal, DELEGATE) {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	}
+	env.results = append(env.results, Result{
+		Status: "SHOW_DELEGATIONS",
+		Output: env.listDelegations(cmd.ident),
+	})
+	return SUCCESS
+}
+
+func (cmd CmdClearLockouts) execute(env *ProgramEnv) int {
+	if !env.globals.db.isUserAdmin(env.principal) {
+		env.results = []Result{ Result{Status: "DENIED"} }
+		return DENIED
+	}
+	// counters aren't part of the db, so only clear them on commit
+	env.onCommit = append(env.onCommit, func() {
+		env.globals.logins.clear(cmd.name)
+	})
+	env.results = append(env.results, Result{Status: "CLEAR_LOCKOUTS"})
+	return SUCCESS
+}
+
 // to fail, just assign: env.results := []Result{ Result{"status":"DENIED"} }
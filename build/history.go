@@ -0,0 +1,151 @@
+package main
+
+import (
+	"time"
+)
+
+// committed versions of the globals, for `return x at version n`,
+// `return x as of "<ts>"` and `revert x to version n`.
+// the history lives outside the database: it's only updated once a program
+// commits (see storeGlobalVar), so rolled back writes never show up in it.
+// every variable keeps its last historyVersions versions (or the number set
+// w/ `set history x = n`), and the oldest versions of all variables are
+// evicted first once the history exceeds historyBudget bytes.
+
+type VarHistory struct {
+	versions []*EntryVar // oldest first
+	limit    int         // -1 = historyVersions
+}
+
+type historyRef struct {
+	name    string
+	version int64
+}
+
+type History struct {
+	vars  map[string]*VarHistory
+	order []historyRef // in the order the versions were recorded
+	count int          // versions in vars
+	size  int          // approx. bytes of all versions
+}
+
+func NewHistory() *History {
+	return &History{vars: make(map[string]*VarHistory, 0)}
+}
+
+// approx. memory of a value
+func entrySize(ev *EntryVar) int {
+	s := 64 + len(ev.value)
+	for k, f := range ev.fieldValues {
+		s += len(k) + entrySize(f)
+	}
+	for _, l := range ev.list {
+		s += entrySize(l)
+	}
+	return s
+}
+
+func (h *History) limitOf(vh *VarHistory) int {
+	if vh.limit < 0 {
+		return historyVersions
+	}
+	return vh.limit
+}
+
+// records the committed state of a variable, ev = nil if it was deleted
+func (h *History) record(name string, ev *EntryVar) {
+	vh, ok := h.vars[name]
+	if ev == nil {
+		if ok {
+			h.drop(name, len(vh.versions))
+			delete(h.vars, name)
+		}
+		return
+	}
+	if !ok {
+		vh = &VarHistory{limit: -1}
+		h.vars[name] = vh
+	}
+	// a variable that was deleted and created again starts over
+	if n := len(vh.versions); n > 0 && vh.versions[n-1].version >= ev.version {
+		h.drop(name, n)
+	}
+	vh.versions = append(vh.versions, copyEntryVar(ev))
+	h.order = append(h.order, historyRef{name, ev.version})
+	h.count++
+	h.size += entrySize(ev)
+	h.trim(name)
+	h.evict()
+}
+
+func (h *History) setLimit(name string, limit int) {
+	vh, ok := h.vars[name]
+	if !ok {
+		vh = &VarHistory{}
+		h.vars[name] = vh
+	}
+	vh.limit = limit
+	h.trim(name)
+}
+
+// removes the n oldest versions of a variable
+func (h *History) drop(name string, n int) {
+	vh := h.vars[name]
+	for _, ev := range vh.versions[:n] {
+		h.count--
+		h.size -= entrySize(ev)
+	}
+	vh.versions = append([]*EntryVar(nil), vh.versions[n:]...)
+}
+
+func (h *History) trim(name string) {
+	vh := h.vars[name]
+	if over := len(vh.versions) - h.limitOf(vh); over > 0 {
+		h.drop(name, over)
+	}
+}
+
+// drops the oldest versions until the history fits into the budget
+func (h *History) evict() {
+	for h.size > historyBudget && len(h.order) > 0 {
+		ref := h.order[0]
+		h.order = h.order[1:]
+		vh, ok := h.vars[ref.name]
+		if ok && len(vh.versions) > 0 && vh.versions[0].version == ref.version {
+			h.drop(ref.name, 1)
+		}
+	}
+	// forget the refs of versions that are gone already
+	if len(h.order) > 2*h.count+64 {
+		live := make([]historyRef, 0, h.count)
+		for _, ref := range h.order {
+			if h.at(ref.name, ref.version) != nil {
+				live = append(live, ref)
+			}
+		}
+		h.order = live
+	}
+}
+
+func (h *History) at(name string, version int64) *EntryVar {
+	if vh, ok := h.vars[name]; ok {
+		for _, ev := range vh.versions {
+			if ev.version == version {
+				return ev
+			}
+		}
+	}
+	return nil
+}
+
+// the version that was current at t
+func (h *History) asOf(name string, t time.Time) *EntryVar {
+	if vh, ok := h.vars[name]; ok {
+		for i := len(vh.versions) - 1; i >= 0; i-- {
+			if !vh.versions[i].modified.After(t) {
+				return vh.versions[i]
+			}
+		}
+	}
+	return nil
+}
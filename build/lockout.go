@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// brute-force protection for `as principal` logins.
+// failures are counted per principal and per remote host. once a counter
+// reaches its threshold, logins are refused for a window that doubles with
+// every further failure. a host gets a higher threshold than a principal,
+// as it may be shared by several users. failures are forgotten after a
+// quiet period of the maximum lockout. the counters live outside the
+// database, so they survive the rollback of the (denied) program.
+
+type LoginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+type LoginGuard struct {
+	principals map[string]*LoginFailures
+	remotes    map[string]*LoginFailures
+}
+
+func NewLoginGuard() *LoginGuard {
+	return &LoginGuard{
+		principals: make(map[string]*LoginFailures, 0),
+		remotes:    make(map[string]*LoginFailures, 0),
+	}
+}
+
+// strips the port, so reconnecting doesn't reset the counter
+func remoteHost(remote string) string {
+	if h, _, err := net.SplitHostPort(remote); err == nil {
+		return h
+	}
+	return remote
+}
+
+func (g *LoginGuard) isLocked(principal, remote string, now time.Time) bool {
+	if f, ok := g.principals[principal]; ok && now.Before(f.lockedUntil) {
+		return true
+	}
+	if f, ok := g.remotes[remote]; ok && now.Before(f.lockedUntil) {
+		return true
+	}
+	return false
+}
+
+func (g *LoginGuard) failed(principal string, principalExists bool,
+	remote string, now time.Time) {
+	// unknown names are only counted per host, so they can't fill the map
+	if principalExists {
+		g.principals[principal] = countFailure(g.principals[principal],
+			lockoutThreshold, now)
+	}
+	g.remotes[remote] = countFailure(g.remotes[remote],
+		lockoutRemoteThreshold, now)
+}
+
+func countFailure(f *LoginFailures, threshold int, now time.Time) *LoginFailures {
+	if f == nil || now.Sub(f.lastFailure) > lockoutMax {
+		f = &LoginFailures{}
+	}
+	f.count++
+	f.lastFailure = now
+	if f.count >= threshold {
+		f.lockedUntil = now.Add(lockoutDuration(f.count - threshold))
+	}
+	return f
+}
+
+// base * 2^n, capped at the configured maximum
+func lockoutDuration(n int) time.Duration {
+	d := lockoutBase
+	for i := 0; i < n && d < lockoutMax; i++ {
+		d *= 2
+	}
+	if d > lockoutMax {
+		d = lockoutMax
+	}
+	return d
+}
+
+// only the principal is reset, otherwise any valid account would reset
+// the counter of the host
+func (g *LoginGuard) succeeded(principal string) {
+	delete(g.principals, principal)
+}
+
+// removes the counters of a principal or host, or all of them if name is ""
+func (g *LoginGuard) clear(name string) {
+	if name == "" {
+		g.principals = make(map[string]*LoginFailures, 0)
+		g.remotes = make(map[string]*LoginFailures, 0)
+		return
+	}
+	delete(g.principals, name)
+	delete(g.remotes, name)
+}
+
+func (g *LoginGuard) list(now time.Time) []map[string]interface{} {
+	l := make([]map[string]interface{}, 0)
+	add := func(kind string, m map[string]*LoginFailures) {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			f := m[k]
+			item := map[string]interface{}{kind: k, "failures": f.count}
+			if now.Before(f.lockedUntil) {
+				item["locked_until"] = f.lockedUntil.UTC().Format(time.RFC3339)
+			}
+			l = append(l, item)
+		}
+	}
+	add("principal", g.principals)
+	add("remote", g.remotes)
+	return l
+}
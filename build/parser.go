@@ -2,12 +2,15 @@ package main
 
 import (
 	"strings"
+	"strconv"
 	"fmt"
+	"time"
 )
 
 type Parser struct {
 	rawPrg string
 	prg Program
+	blocks []*openBlock // open `if`/`define`/`on` blocks, innermost last
 	buf struct {
 		tok Token // last read token
 		lit string // last read literal
@@ -26,6 +29,54 @@ type Cmd interface {
 type CmdComment struct {
 }
 
+// if <expr> then <cmd> [else <cmd>], or the block form:
+// if <expr> then / <cmds> / [else / <cmds>] / end
+type CmdIf struct {
+	cond Expr
+	then []Cmd
+	els []Cmd
+}
+
+// define procedure <name>(<param>, ..) [as definer] do / <cmds> / end
+type CmdDefineProc struct {
+	name string
+	params []string
+	definerRights bool
+	body []Cmd
+}
+
+// on write to <ident> do / <cmds> / end
+type CmdOnWrite struct {
+	ident string
+	body []Cmd
+}
+
+// reject
+type CmdReject struct {}
+
+// call <name>(<expr>, ..)
+type CmdCall struct {
+	name string
+	args []Expr
+}
+
+// a line of the block forms (`if <expr> then`, `define procedure ..`,
+// `on write to ..`, `else` or `end`), only used while parsing
+type CmdBlock struct {
+	kind Token
+	cond Expr
+	proc CmdDefineProc
+	trigger CmdOnWrite
+}
+
+type openBlock struct {
+	kind Token // KV_IF, KV_DEFINE or KV_ON
+	ifCmd CmdIf
+	inElse bool
+	proc CmdDefineProc
+	trigger CmdOnWrite
+}
+
 type CmdReturn struct {
 	expr Expr
 }
@@ -36,16 +87,20 @@ type CmdExit struct {
 type CmdAsPrincipal struct {
 	principal string
 	pw string
+	readonly bool
 }
 
 type CmdSet struct {
 	ident string
+	path []string // set x.f.g = .., empty = the whole variable
 	expr Expr
 }
 
 type CmdCreatePr struct {
 	principal string
 	pw string
+	pwArg string // param holding the pw, in procedures
+	readonly bool
 }
 
 type CmdChangePw struct {
@@ -69,11 +124,79 @@ type CmdForeach struct {
 	expr Expr
 }
 
+type CmdReturnMeta struct {
+	ident string
+}
+
+// return x at version n | return x as of "<ts>"
+type CmdReturnVersion struct {
+	ident string
+	version int64 // 0 = as of asOf
+	asOf time.Time
+}
+
+type CmdRevert struct {
+	ident string
+	version int64
+}
+
+type CmdSetHistory struct {
+	ident string
+	limit int
+}
+
+// set quota p [vars <n>|unlimited] [bytes <n>|unlimited]
+type CmdSetQuota struct {
+	p string
+	maxVars *int // nil = unchanged, -1 = unlimited
+	maxBytes *int
+}
+
+type CmdShowQuota struct {
+	p string
+}
+
+// create index on <ident>(<field>)
+type CmdCreateIndex struct {
+	ident string
+	field string
+}
+
+type CmdShowIndexes struct {}
+
+// declare schema <name> {<field>, <field>?, ..}
+type CmdDeclareSchema struct {
+	name string
+	fields map[string]bool // true = required
+}
+
+// bind schema <name> to <ident>
+type CmdBindSchema struct {
+	name string
+	ident string
+}
+
+type CmdShowSchema struct {
+	name string
+}
+
+type CmdSort struct {
+	ident string
+	field string // "" = sort the entries themselves
+	desc bool
+}
+
 type CmdSetDeleg struct {
 	tgt string
 	q string
 	right AccessRight
 	p string
+	until time.Time // `until "<RFC3339>"`, zero = never
+	lifetime time.Duration // `for "<duration>"`, 0 = never
+}
+
+type CmdDeleteVar struct {
+	ident string
 }
 
 type CmdDeleteDeleg struct {
@@ -83,8 +206,34 @@ type CmdDeleteDeleg struct {
 	p string
 }
 
+// same syntax as delegations, w/ `denial` instead of `delegation`
+type CmdSetDenial CmdSetDeleg
+
+type CmdDeleteDenial CmdDeleteDeleg
+
 type CmdDefaultDeleg struct {
 	p string
+	setMode bool // `live` or `copy` given, otherwise the mode is kept
+	live bool
+}
+
+type CmdGrantAdmin struct {
+	p string
+}
+
+type CmdRevokeAdmin struct {
+	p string
+}
+
+type CmdShowLockouts struct {
+}
+
+type CmdShowDelegations struct {
+	ident string
+}
+
+type CmdClearLockouts struct {
+	name string // principal or remote host, "" = all
 }
 
 type Expr interface {
@@ -93,6 +242,10 @@ type Expr interface {
 	// x
 	// x.y
 	// "string"
+	// 42
+	// add(<val>, <val>), lt(<val>, <val>), tonum(<val>), ..
+	// <val>[i], <val>[i:j], len(<val>), <val>.f
+	// <val> with {x=<val>, ..}
 	eval(env *ProgramEnv) (int, *Value)
 }
 
@@ -103,6 +256,10 @@ type ExprFieldAcc struct {
 	ident string
 	field string
 }
+type ExprField struct {
+	rec Expr
+	field string
+}
 type ExprString struct {
 	val string
 }
@@ -111,6 +268,48 @@ type ExprEmptyList struct {
 type ExprRecord struct {
 	fields map[string]Expr
 }
+type ExprMerge struct {
+	rec Expr
+	with ExprRecord // overrides/adds fields
+}
+type ExprNumber struct {
+	num int64
+}
+type ExprArith struct {
+	op string // add, sub, mul
+	a Expr
+	b Expr
+}
+type ExprCompare struct {
+	op string // equal, notequal, lt, le, gt, ge
+	a Expr
+	b Expr
+}
+type ExprToNum struct {
+	expr Expr
+}
+type ExprIndex struct {
+	list Expr
+	index Expr
+}
+type ExprSlice struct {
+	list Expr
+	from Expr // nil = start of the list
+	to Expr // nil = end of the list
+}
+type ExprLen struct {
+	expr Expr
+}
+// select [<field>, ..] from <ident> [where <field> = <value> [and ..]]
+type ExprSelect struct {
+	ident string
+	fields []string // nil = whole entries
+	where []SelectCond
+}
+type SelectCond struct {
+	field string
+	val Expr
+}
 
 func newParser(p string) (*Parser) {
 	return &Parser{rawPrg: p}
@@ -130,7 +329,12 @@ func parseProgram(prg string) (int, *Program) {
 		c, cmd := parser.parseLine(i, l)
 		if c == 0 { // successful
 			if cmd != nil {
-				parser.prg.cmds = append(parser.prg.cmds, cmd)
+				if !parser.add(cmd) {
+					return 2, nil
+				}
+			} else if len(parser.blocks) > 0 {
+				parseError("missing END")
+				return 2, nil
 			} else { // terminated
 				return 0, &parser.prg
 			}
@@ -141,15 +345,98 @@ func parseProgram(prg string) (int, *Program) {
 	return 2, nil
 }
 
+// adds cmd to the innermost open block, or the program
+func (p *Parser) add(cmd Cmd) bool {
+	if b, ok := cmd.(CmdBlock); ok {
+		var top *openBlock
+		if len(p.blocks) > 0 {
+			top = p.blocks[len(p.blocks)-1]
+		}
+		switch b.kind {
+		case KV_IF:
+			p.blocks = append(p.blocks, &openBlock{kind: KV_IF, ifCmd: CmdIf{cond: b.cond}})
+			return true
+		case KV_DEFINE, KV_ON:
+			if top != nil {
+				parseError("DEFINE/ON must not be nested")
+				return false
+			}
+			p.blocks = append(p.blocks, &openBlock{kind: b.kind, proc: b.proc,
+				trigger: b.trigger})
+			return true
+		case KV_ELSE:
+			if top == nil || top.kind != KV_IF || top.inElse {
+				parseError("unexpected ELSE")
+				return false
+			}
+			top.inElse = true
+			return true
+		default: // KV_END
+			if top == nil {
+				parseError("unexpected END")
+				return false
+			}
+			p.blocks = p.blocks[:len(p.blocks)-1]
+			switch top.kind {
+			case KV_IF:
+				cmd = top.ifCmd
+			case KV_DEFINE:
+				cmd = top.proc
+			default:
+				cmd = top.trigger
+			}
+		}
+	} else if len(p.blocks) > 0 && p.blocks[0].kind != KV_IF && !isProcedureCmd(cmd) {
+		parseError("invalid command in procedure/trigger")
+		return false
+	}
+	if len(p.blocks) == 0 {
+		p.prg.cmds = append(p.prg.cmds, cmd)
+	} else if b := p.blocks[len(p.blocks)-1]; b.kind == KV_DEFINE {
+		b.proc.body = append(b.proc.body, cmd)
+	} else if b.kind == KV_ON {
+		b.trigger.body = append(b.trigger.body, cmd)
+	} else if b.inElse {
+		b.ifCmd.els = append(b.ifCmd.els, cmd)
+	} else {
+		b.ifCmd.then = append(b.ifCmd.then, cmd)
+	}
+	return true
+}
+
+func (p *Parser) inProcedure() bool {
+	return len(p.blocks) > 0 && p.blocks[0].kind == KV_DEFINE
+}
+
+// procedures and triggers run inside the calling program, so they can't end it
+func isProcedureCmd(cmd Cmd) bool {
+	switch c := cmd.(type) {
+	case CmdReturn, CmdReturnMeta, CmdReturnVersion, CmdExit, CmdAsPrincipal:
+		return false
+	case CmdIf:
+		for _, b := range [][]Cmd{c.then, c.els} {
+			for _, cmd := range b {
+				if !isProcedureCmd(cmd) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
 // 0=success, 1=unfinished, 2=parseError
 func (p *Parser) parseLine(i int, l string) (int, Cmd) {
 	// get tokens
 	tokenizer := NewTokenizer(strings.NewReader(l))
+	return p.parseCmd(tokenizer)
+}
 
+func (p *Parser) parseCmd(tokenizer *Tokenizer) (int, Cmd) {
 	// loop through tokens
 	for {
-		tok, _ := tokenizer.Scan()
-		switch tok {
+		tok, lit := tokenizer.Scan()
+		switch keyword(tok, lit) {
 			case EOF: return 1, nil // not implemented function
 			case KV_TERMINATE: return 0, nil
 			case KV_EXIT: return p.parseCmdExit(tokenizer)
@@ -161,8 +448,23 @@ func (p *Parser) parseLine(i int, l string) (int, Cmd) {
 			case KV_APPEND: return p.parseCmdAppend(tokenizer)
 			case KV_LOCAL: return p.parseCmdLocal(tokenizer)
 			case KV_FOREACH: return p.parseCmdForeach(tokenizer)
-			case KV_DELETE: return p.parseCmdDeleteDeleg(tokenizer)
+			case KV_SORT: return p.parseCmdSort(tokenizer)
+			case KV_REVERT: return p.parseCmdRevert(tokenizer)
+			case KV_DELETE: return p.parseCmdDelete(tokenizer)
 			case KV_DEFAULT: return p.parseCmdDefaultDeleg(tokenizer)
+			case KV_SHOW: return p.parseCmdShow(tokenizer)
+			case KV_DECLARE: return p.parseCmdDeclareSchema(tokenizer)
+			case KV_BIND: return p.parseCmdBindSchema(tokenizer)
+			case KV_GRANT: return p.parseCmdGrantAdmin(tokenizer)
+			case KV_REVOKE: return p.parseCmdRevokeAdmin(tokenizer)
+			case KV_CLEAR: return p.parseCmdClearLockouts(tokenizer)
+			case KV_IF: return p.parseCmdIf(tokenizer)
+			case KV_DEFINE: return p.parseCmdDefineProc(tokenizer)
+			case KV_ON: return p.parseCmdOnWrite(tokenizer)
+			case KV_REJECT: return p.parseCmdReject(tokenizer)
+			case KV_CALL: return p.parseCmdCall(tokenizer)
+			case KV_ELSE: return p.parseCmdBlockEnd(tokenizer, KV_ELSE)
+			case KV_END: return p.parseCmdBlockEnd(tokenizer, KV_END)
 			case COMMENT: return p.parseCmdComment(tokenizer)
 			default: return 1, nil
 		}
@@ -171,19 +473,337 @@ func (p *Parser) parseLine(i int, l string) (int, Cmd) {
 	return 2, nil
 }
 
+func (p *Parser) parseCmdIf(t *Tokenizer) (int, Cmd) {
+	s, cond := p.parseExpr(t)
+	if s != 0 {
+		parseError("invalid condition in CmdIf")
+		return 2, nil
+	}
+	if tok, lit := t.Scan(); keyword(tok, lit) != KV_THEN {
+		parseError("expected THEN in CmdIf")
+		return 2, nil
+	}
+	// block form
+	if tok, lit := t.Scan(); tok == EOF {
+		return 0, CmdBlock{kind: KV_IF, cond: cond}
+	} else {
+		t.Unscan(tok, lit)
+	}
+
+	cmd := CmdIf{cond: cond}
+	t.stopAt = KV_ELSE
+	s, then := p.parseBranch(t)
+	t.stopAt = ILLEGAL
+	if s != 0 {
+		return s, nil
+	}
+	cmd.then = []Cmd{then}
+	tok, lit := t.Scan()
+	if tok == EOF {
+		return 0, cmd
+	} else if keyword(tok, lit) != KV_ELSE {
+		parseError("expected ELSE or EOF in CmdIf")
+		return 2, nil
+	}
+	s, els := p.parseBranch(t)
+	if s != 0 {
+		return s, nil
+	}
+	cmd.els = []Cmd{els}
+	return 0, cmd
+}
+
+// a single command of the inline form, which can't be an `if` itself
+func (p *Parser) parseBranch(t *Tokenizer) (int, Cmd) {
+	tok, lit := t.Scan()
+	switch keyword(tok, lit) {
+	case KV_IF, KV_ELSE, KV_END, KV_DEFINE, KV_ON, KV_TERMINATE, KV_AS, COMMENT, EOF:
+		parseError("invalid command in CmdIf")
+		return 2, nil
+	}
+	t.Unscan(tok, lit)
+	s, cmd := p.parseCmd(t)
+	if s != 0 || cmd == nil {
+		return 2, nil
+	}
+	return 0, cmd
+}
+
+func (p *Parser) parseCmdDefineProc(t *Tokenizer) (int, Cmd) {
+	if tok, lit := t.Scan(); keyword(tok, lit) != KV_PROCEDURE {
+		parseError("expected PROCEDURE in CmdDefineProc")
+		return 2, nil
+	}
+	tok, name := t.Scan()
+	if tok != IDENT {
+		parseError("expected IDENT in CmdDefineProc")
+		return 2, nil
+	}
+	proc := CmdDefineProc{name: name, params: make([]string, 0)}
+
+	// (<param>, ..)
+	if tok, _ := t.Scan(); tok != PAREN_OPEN {
+		parseError("expected '(' in CmdDefineProc")
+		return 2, nil
+	}
+	tok, lit := t.Scan()
+	for tok != PAREN_CLOSE {
+		if tok != IDENT || isQualified(lit) {
+			parseError("expected IDENT-param in CmdDefineProc")
+			return 2, nil
+		}
+		for _, param := range proc.params {
+			if param == lit {
+				parseError("duplicate param in CmdDefineProc")
+				return 2, nil
+			}
+		}
+		proc.params = append(proc.params, lit)
+		if tok, _ = t.Scan(); tok == COMMA {
+			tok, lit = t.Scan()
+		} else if tok != PAREN_CLOSE {
+			parseError("expected ',' or ')' in CmdDefineProc")
+			return 2, nil
+		}
+	}
+
+	// optional `as definer`
+	tok, _ = t.Scan()
+	if tok == KV_AS {
+		if tok, lit := t.Scan(); keyword(tok, lit) != KV_DEFINER {
+			parseError("expected DEFINER in CmdDefineProc")
+			return 2, nil
+		}
+		proc.definerRights = true
+		tok, _ = t.Scan()
+	}
+	if tok != KV_DO {
+		parseError("expected DO in CmdDefineProc")
+		return 2, nil
+	}
+	if tok, _ := t.Scan(); tok != EOF {
+		parseError("expected EOF in CmdDefineProc")
+		return 2, nil
+	}
+	return 0, CmdBlock{kind: KV_DEFINE, proc: proc}
+}
+
+func (p *Parser) parseCmdOnWrite(t *Tokenizer) (int, Cmd) {
+	if tok, _ := t.Scan(); tok != KV_WRITE {
+		parseError("expected WRITE in CmdOnWrite")
+		return 2, nil
+	}
+	if tok, _ := t.Scan(); tok != KV_TO {
+		parseError("expected TO in CmdOnWrite")
+		return 2, nil
+	}
+	tok, ident := t.Scan()
+	if tok != IDENT {
+		parseError("expected IDENT in CmdOnWrite")
+		return 2, nil
+	}
+	if tok, _ := t.Scan(); tok != KV_DO {
+		parseError("expected DO in CmdOnWrite")
+		return 2, nil
+	}
+	if tok, _ := t.Scan(); tok != EOF {
+		parseError("expected EOF in CmdOnWrite")
+		return 2, nil
+	}
+	return 0, CmdBlock{kind: KV_ON, trigger: CmdOnWrite{ident: ident}}
+}
+
+func (p *Parser) parseCmdReject(t *Tokenizer) (int, Cmd) {
+	if tok, _ := t.Scan(); tok != EOF {
+		parseError("expected EOF in CmdReject")
+		return 2, nil
+	}
+	return 0, CmdReject{}
+}
+
+func (p *Parser) parseCmdCall(t *Tokenizer) (int, Cmd) {
+	tok, name := t.Scan()
+	if tok != IDENT {
+		parseError("expected IDENT in CmdCall")
+		return 2, nil
+	}
+	if tok, _ := t.Scan(); tok != PAREN_OPEN {
+		parseError("expected '(' in CmdCall")
+		return 2, nil
+	}
+	cmd := CmdCall{name: name, args: make([]Expr, 0)}
+	tok, lit := t.Scan()
+	if tok == PAREN_CLOSE {
+		return 0, cmd
+	}
+	t.Unscan(tok, lit)
+	for {
+		s, arg := p.parseExpr(t)
+		if s != 0 {
+			return s, nil
+		}
+		cmd.args = append(cmd.args, arg)
+		tok, _ := t.Scan()
+		if tok == PAREN_CLOSE {
+			return 0, cmd
+		} else if tok != COMMA {
+			parseError("expected ',' or ')' in CmdCall")
+			return 2, nil
+		}
+	}
+}
+
+func (p *Parser) parseCmdBlockEnd(t *Tokenizer, kind Token) (int, Cmd) {
+	if tok, _ := t.Scan(); tok != EOF {
+		parseError("expected EOF after ELSE/END")
+		return 2, nil
+	}
+	return 0, CmdBlock{kind: kind}
+}
+
 func (p *Parser) parseCmdExit(t *Tokenizer) (int, Cmd) {
 	cmd := CmdExit{}
 	return 0, cmd
 }
 
 func (p *Parser) parseCmdReturn(t *Tokenizer) (int, Cmd) {
+	// return meta x, anything else after meta is a variable named meta
+	tok, lit := t.Scan()
+	tok2, lit2 := t.Scan()
+	tok3, lit3 := t.Scan()
+	if keyword(tok, lit) == KV_META && tok2 == IDENT && tok3 == EOF {
+		return 0, CmdReturnMeta{ident: lit2}
+	}
+	t.Unscan(tok3, lit3)
+	t.Unscan(tok2, lit2)
+	t.Unscan(tok, lit)
+
 	// get expression
 	s, expr := p.parseExpr(t)
-	if s == 0 {
+	if s != 0 {
+		parseError("invalid CmdReturn")
+		return 2, nil
+	}
+
+	// an old version of a variable
+	tok, lit = t.Scan()
+	if kw := keyword(tok, lit); kw != KV_AT && kw != KV_AS {
+		t.Unscan(tok, lit)
 		return 0, CmdReturn{expr: expr}
 	}
-	parseError("invalid CmdReturn")
-	return 2, nil
+	ident, ok := expr.(ExprIdent)
+	if !ok {
+		parseError("expected IDENT in CmdReturnVersion")
+		return 2, nil
+	}
+	cmd := CmdReturnVersion{ident: ident.ident}
+	if keyword(tok, lit) == KV_AT {
+		if s, cmd.version = parseVersion(t); s != 0 {
+			return s, nil
+		}
+		return 0, cmd
+	}
+	if tok, lit := t.Scan(); keyword(tok, lit) != KV_OF {
+		parseError("expected OF in CmdReturnVersion")
+		return 2, nil
+	}
+	tok, ts := t.Scan()
+	if tok != TIMESTAMP {
+		parseError("expected TIMESTAMP in CmdReturnVersion")
+		return 2, nil
+	}
+	cmd.asOf, _ = time.Parse(time.RFC3339Nano, ts) // checked by the tokenizer
+	return 0, cmd
+}
+
+// version <n>, n >= 1
+func parseVersion(t *Tokenizer) (int, int64) {
+	if tok, lit := t.Scan(); keyword(tok, lit) != KV_VERSION {
+		parseError("expected VERSION")
+		return 2, 0
+	}
+	tok, lit := t.Scan()
+	if tok != NUMBER {
+		parseError("expected NUMBER after VERSION")
+		return 2, 0
+	}
+	v, _ := strconv.ParseInt(lit, 10, 64)
+	if v < 1 {
+		parseError("invalid version %d", v)
+		return 2, 0
+	}
+	return 0, v
+}
+
+// revert x to version <n>
+func(*Parser) parseCmdRevert(t *Tokenizer) (int, Cmd) {
+	tok, ident := t.Scan()
+	if tok != IDENT {
+		parseError("expected IDENT in CmdRevert")
+		return 2, nil
+	}
+	if tok, _ := t.Scan(); tok != KV_TO {
+		parseError("expected TO in CmdRevert")
+		return 2, nil
+	}
+	s, v := parseVersion(t)
+	if s != 0 {
+		return s, nil
+	}
+	return 0, CmdRevert{ident: ident, version: v}
+}
+
+// `set quota` is already read
+func(*Parser) parseCmdSetQuota(t *Tokenizer) (int, Cmd) {
+	tok, pr := t.Scan()
+	if tok != IDENT {
+		parseError("expected IDENT in CmdSetQuota")
+		return 2, nil
+	}
+	cmd := CmdSetQuota{p: pr}
+	for {
+		tok, lit := t.Scan()
+		kind := keyword(tok, lit)
+		if tok == EOF && (cmd.maxVars != nil || cmd.maxBytes != nil) {
+			return 0, cmd
+		} else if kind != KV_VARS && kind != KV_BYTES {
+			parseError("expected VARS or BYTES in CmdSetQuota")
+			return 2, nil
+		}
+		tok, lit = t.Scan()
+		n, err := strconv.Atoi(lit)
+		if keyword(tok, lit) == KV_UNLIMITED {
+			n = -1
+		} else if tok != NUMBER || err != nil || n < 0 {
+			parseError("expected NUMBER >= 0 or UNLIMITED in CmdSetQuota")
+			return 2, nil
+		}
+		if kind == KV_VARS {
+			cmd.maxVars = &n
+		} else {
+			cmd.maxBytes = &n
+		}
+	}
+}
+
+// set history x = <n>, `set history` is already read
+func(*Parser) parseCmdSetHistory(t *Tokenizer) (int, Cmd) {
+	tok, ident := t.Scan()
+	if tok != IDENT {
+		parseError("expected IDENT in CmdSetHistory")
+		return 2, nil
+	}
+	if tok, _ := t.Scan(); tok != EQUAL {
+		parseError("expected EQ in CmdSetHistory")
+		return 2, nil
+	}
+	tok, lit := t.Scan()
+	n, err := strconv.Atoi(lit)
+	if tok != NUMBER || err != nil || n < 0 {
+		parseError("expected NUMBER >= 0 in CmdSetHistory")
+		return 2, nil
+	}
+	return 0, CmdSetHistory{ident: ident, limit: n}
 }
 
 func (p *Parser) parseCmdAsPrincipal(t *Tokenizer) (int, Cmd) {
@@ -223,24 +843,58 @@ func (p *Parser) parseCmdAsPrincipal(t *Tokenizer) (int, Cmd) {
 		return 2, nil
 	}
 
+	// optional readonly token
+	if tok, lit := t.Scan(); keyword(tok, lit) == KV_READONLY {
+		cmd.readonly = true
+	} else {
+		t.Unscan(tok, lit)
+	}
+
 	return 0, cmd
 }
 
 func (p *Parser) parseCmdSet(t *Tokenizer) (int, Cmd) {
 	cmd := CmdSet{}
 
-	// get identifier
+	// get identifier, `set denial x ..` but `set denial = ..`
 	tok, ident := t.Scan()
+	if kw := keyword(tok, ident); kw != tok {
+		next, lit := t.Scan()
+		t.Unscan(next, lit)
+		if next == IDENT {
+			tok = kw
+		}
+	}
 	if tok == KV_DELEGATION {
 		return p.parseCmdSetDeleg(t)
+	} else if tok == KV_HISTORY {
+		return p.parseCmdSetHistory(t)
+	} else if tok == KV_QUOTA {
+		return p.parseCmdSetQuota(t)
+	} else if tok == KV_DENIAL {
+		s, cmd := p.parseCmdSetDeleg(t)
+		if s != 0 {
+			return s, nil
+		}
+		return 0, CmdSetDenial(cmd.(CmdSetDeleg))
 	} else if tok != IDENT {
 		parseError("expected IDENT in CmdSet")
 		return 2, nil
 	}
 	cmd.ident = ident
 
-	// read eq token
-	if tok, _ := t.Scan(); tok != EQUAL {
+	// read eq token, or a field path: x.f.g
+	tok, _ = t.Scan()
+	for tok == DOT {
+		fTok, f := t.Scan()
+		if fTok != IDENT {
+			parseError("expected IDENT-field in CmdSet")
+			return 2, nil
+		}
+		cmd.path = append(cmd.path, f)
+		tok, _ = t.Scan()
+	}
+	if tok != EQUAL {
 		parseError("expected EQ in CmdSet")
 		return 2, nil
 	}
@@ -248,7 +902,8 @@ func (p *Parser) parseCmdSet(t *Tokenizer) (int, Cmd) {
 	// get expression
 	s, expr := p.parseExpr(t)
 	if s == 0 {
-		return 0, CmdSet{ident: ident, expr: expr}
+		cmd.expr = expr
+		return 0, cmd
 	}
 	parseError("invalid CmdSet")
 	return 2, nil
@@ -259,55 +914,156 @@ func (p *Parser) parseExpr(t *Tokenizer) (int, Expr) {
 	if tok == EMPTYLIST {
 		return 0, ExprEmptyList{}
 	} else if tok == BRACKET_OPEN {
-		// parse record
-		fields := make(map[string]Expr, 0)
+		return p.parseRecord(t)
+	} else {
+		t.Unscan(tok, e)
+		s, expr := p.parseValue(t)
+		if s != 0 {
+			return s, nil
+		}
+		// any number of `with {..}`
 		for {
-			// read ident
-			iTok, iExp := t.Scan()
-			if iTok != IDENT {
-				parseError("expected IDENT in record")
-				return 2, nil
+			tok, lit := t.Scan()
+			if tok != KV_WITH {
+				t.Unscan(tok, lit)
+				return 0, expr
 			}
-			// read EQUAL
-			if eTok, _ := t.Scan(); eTok != EQUAL {
-				parseError("expected EQ in record")
+			if tok, _ := t.Scan(); tok != BRACKET_OPEN {
+				parseError("expected record after WITH")
 				return 2, nil
 			}
-			// read <value>
-			s, valExp := p.parseValue(t)
-			if s == 0 {
-				if _, exists := fields[iExp]; exists {
-					parseError("duplicate key in record")
-					return 2, nil
-				}
-				fields[iExp] = valExp
-			} else {
-				parseError("invalid value in record")
-				return 2, nil
+			s, with := p.parseRecord(t)
+			if s != 0 {
+				return s, nil
 			}
-			// check for comma, bracket or EOF/INVALID
-			fTok, _ := t.Scan()
-			if fTok == BRACKET_CLOSE {
-				// successful parse
-				return 0, ExprRecord{fields: fields}
-			} else if fTok == COMMA {
-				continue
-			} else {
-				parseError("invalid field in record")
+			expr = ExprMerge{rec: expr, with: with.(ExprRecord)}
+		}
+	}
+}
+
+// { is already read
+func (p *Parser) parseRecord(t *Tokenizer) (int, Expr) {
+	fields := make(map[string]Expr, 0)
+	for {
+		// read ident
+		iTok, iExp := t.Scan()
+		if iTok != IDENT {
+			parseError("expected IDENT in record")
+			return 2, nil
+		}
+		// read EQUAL
+		if eTok, _ := t.Scan(); eTok != EQUAL {
+			parseError("expected EQ in record")
+			return 2, nil
+		}
+		// read <value>, which may be a record or list itself
+		s, valExp := p.parseExpr(t)
+		if s == 0 {
+			if _, exists := fields[iExp]; exists {
+				parseError("duplicate key in record")
 				return 2, nil
 			}
+			fields[iExp] = valExp
+		} else {
+			parseError("invalid value in record")
+			return 2, nil
+		}
+		// check for comma, bracket or EOF/INVALID
+		fTok, _ := t.Scan()
+		if fTok == BRACKET_CLOSE {
+			// successful parse
+			return 0, ExprRecord{fields: fields}
+		} else if fTok == COMMA {
+			continue
+		} else {
+			parseError("invalid field in record")
+			return 2, nil
 		}
-	} else {
-		t.Unscan(tok, e)
-		return p.parseValue(t)
 	}
 }
 
 func (p *Parser) parseValue(t *Tokenizer) (int, Expr) {
+	s, expr := p.parsePrimary(t)
+	if s != 0 {
+		return s, nil
+	}
+	// any number of [i], [i:j] or .f
+	for {
+		tok, lit := t.Scan()
+		if tok == DOT {
+			fTok, f := t.Scan()
+			if fTok != IDENT {
+				parseError("Expected Identifier after '.'")
+				return 2, nil
+			}
+			expr = ExprField{rec: expr, field: f}
+			continue
+		} else if tok != SQUARE_OPEN {
+			t.Unscan(tok, lit)
+			return 0, expr
+		}
+		s, expr = p.parseIndex(t, expr)
+		if s != 0 {
+			return s, nil
+		}
+	}
+}
+
+// [ is already read
+func (p *Parser) parseIndex(t *Tokenizer, list Expr) (int, Expr) {
+	var from, to Expr
+	tok, lit := t.Scan()
+	if tok != COLON {
+		t.Unscan(tok, lit)
+		s, e := p.parseExpr(t)
+		if s != 0 {
+			return s, nil
+		}
+		from = e
+		tok, _ = t.Scan()
+		if tok == SQUARE_CLOSE {
+			return 0, ExprIndex{list: list, index: from}
+		} else if tok != COLON {
+			parseError("expected ']' or ':' in index")
+			return 2, nil
+		}
+	}
+	// slice, : is read
+	tok, lit = t.Scan()
+	if tok != SQUARE_CLOSE {
+		t.Unscan(tok, lit)
+		s, e := p.parseExpr(t)
+		if s != 0 {
+			return s, nil
+		}
+		to = e
+		if tok, _ := t.Scan(); tok != SQUARE_CLOSE {
+			parseError("expected ']' in slice")
+			return 2, nil
+		}
+	}
+	return 0, ExprSlice{list: list, from: from, to: to}
+}
+
+func (p *Parser) parsePrimary(t *Tokenizer) (int, Expr) {
 	tok, exp := t.Scan()
 	if tok == STRING {
 		return 0, ExprString{val: exp}
+	} else if tok == NUMBER {
+		n, _ := strconv.ParseInt(exp, 10, 64) // checked by the tokenizer
+		return 0, ExprNumber{num: n}
+	} else if tok == KV_EQUAL || tok == KV_NOTEQUAL {
+		return p.parseFunc(t, strings.ToLower(exp))
+	} else if keyword(tok, exp) == KV_SELECT && isSelect(t) {
+		return p.parseSelect(t)
 	} else if tok == IDENT {
+		// check if its a function call
+		if tok2, exp2 := t.Scan(); tok2 == PAREN_OPEN {
+			t.Unscan(tok2, exp2)
+			return p.parseFunc(t, exp)
+		} else {
+			t.Unscan(tok2, exp2)
+		}
 		// check if its a field access
 		if tok2, exp2 := t.Scan(); tok2 == DOT {
 			if tok3, exp3 := t.Scan(); tok3 == IDENT {
@@ -325,18 +1081,141 @@ func (p *Parser) parseValue(t *Tokenizer) (int, Expr) {
 	return 2, nil
 }
 
+// `select` starts a query if followed by `<field>,`, `<field> from` or
+// `from <ident>`, otherwise it's a variable (`return select at version 2`)
+func isSelect(t *Tokenizer) bool {
+	tok, lit := t.Scan()
+	tok2, lit2 := t.Scan()
+	t.Unscan(tok2, lit2)
+	t.Unscan(tok, lit)
+	if tok != IDENT {
+		return false
+	} else if keyword(tok, lit) == KV_FROM {
+		return tok2 == IDENT
+	}
+	return tok2 == COMMA || keyword(tok2, lit2) == KV_FROM
+}
+
+// SELECT is already read
+func (p *Parser) parseSelect(t *Tokenizer) (int, Expr) {
+	expr := ExprSelect{}
+
+	// optional projection, a field after ',' may be named `from`
+	tok, lit := t.Scan()
+	if keyword(tok, lit) != KV_FROM {
+		for {
+			if tok != IDENT {
+				parseError("expected IDENT-field or FROM in ExprSelect")
+				return 2, nil
+			}
+			expr.fields = append(expr.fields, lit)
+			if tok, lit = t.Scan(); keyword(tok, lit) == KV_FROM {
+				break
+			} else if tok != COMMA {
+				parseError("expected ',' or FROM in ExprSelect")
+				return 2, nil
+			}
+			tok, lit = t.Scan()
+		}
+	}
+	tok, lit = t.Scan()
+	if tok != IDENT {
+		parseError("expected IDENT in ExprSelect")
+		return 2, nil
+	}
+	expr.ident = lit
+
+	// optional conditions
+	if tok, lit := t.Scan(); keyword(tok, lit) != KV_WHERE {
+		t.Unscan(tok, lit)
+		return 0, expr
+	}
+	for {
+		tok, field := t.Scan()
+		if tok != IDENT {
+			parseError("expected IDENT-field in ExprSelect")
+			return 2, nil
+		}
+		if tok, _ := t.Scan(); tok != EQUAL {
+			parseError("expected '=' in ExprSelect")
+			return 2, nil
+		}
+		s, val := p.parseValue(t)
+		if s != 0 {
+			return s, nil
+		}
+		expr.where = append(expr.where, SelectCond{field: field, val: val})
+		// `and` only goes on if a field follows
+		tok, lit := t.Scan()
+		tok2, lit2 := t.Scan()
+		t.Unscan(tok2, lit2)
+		if keyword(tok, lit) != KV_AND || tok2 != IDENT {
+			t.Unscan(tok, lit)
+			return 0, expr
+		}
+	}
+}
+
+// <name>(<expr>, ..), the name is already read
+func (p *Parser) parseFunc(t *Tokenizer, name string) (int, Expr) {
+	if tok, _ := t.Scan(); tok != PAREN_OPEN {
+		parseError("expected '(' after %s", name)
+		return 2, nil
+	}
+	args := make([]Expr, 0)
+	for {
+		s, arg := p.parseExpr(t)
+		if s != 0 {
+			return s, nil
+		}
+		args = append(args, arg)
+		tok, _ := t.Scan()
+		if tok == PAREN_CLOSE {
+			break
+		} else if tok != COMMA {
+			parseError("expected ',' or ')' in arguments of %s", name)
+			return 2, nil
+		}
+	}
+	switch name {
+	case "add", "sub", "mul":
+		if len(args) == 2 {
+			return 0, ExprArith{op: name, a: args[0], b: args[1]}
+		}
+	case "equal", "notequal", "lt", "le", "gt", "ge":
+		if len(args) == 2 {
+			return 0, ExprCompare{op: name, a: args[0], b: args[1]}
+		}
+	case "tonum":
+		if len(args) == 1 {
+			return 0, ExprToNum{expr: args[0]}
+		}
+	case "len":
+		if len(args) == 1 {
+			return 0, ExprLen{expr: args[0]}
+		}
+	default:
+		parseError("unknown function %s", name)
+		return 2, nil
+	}
+	parseError("wrong number of arguments for %s", name)
+	return 2, nil
+}
+
 func(p *Parser) parseCmdCreatePr(t *Tokenizer) (int, Cmd) {
 	cmd := CmdCreatePr{}
 
 	// read PRINCIPAL token
-	if tok, _ := t.Scan(); tok != KV_PRINCIPAL {
+	if tok, lit := t.Scan(); keyword(tok, lit) == KV_INDEX {
+		return p.parseCmdCreateIndex(t)
+	} else if tok != KV_PRINCIPAL {
 		parseError("expected PR in CmdCreatePr")
 		return 2, nil
 	}
 
 	// get principal
 	tok, pr := t.Scan()
-	if tok != IDENT {
+	if tok != IDENT || isQualified(pr) {
 		parseError("expected IDENT in CmdCreatePr")
 		return 2, nil
 	}
@@ -344,15 +1223,48 @@ func(p *Parser) parseCmdCreatePr(t *Tokenizer) (int, Cmd) {
 
 	// get pw
 	tok, pw := t.Scan()
-	if tok != STRING {
+	if tok == IDENT && p.inProcedure() {
+		cmd.pwArg = pw
+	} else if tok != STRING {
 		parseError("expected STRING in CmdCreatePr")
 		return 2, nil
 	}
 	cmd.pw = pw
 
+	// optional readonly token
+	if tok, lit := t.Scan(); keyword(tok, lit) == KV_READONLY {
+		cmd.readonly = true
+	}
+
 	return 0, cmd
 }
 
+func(p *Parser) parseCmdCreateIndex(t *Tokenizer) (int, Cmd) {
+	if tok, lit := t.Scan(); keyword(tok, lit) != KV_ON {
+		parseError("expected ON in CmdCreateIndex")
+		return 2, nil
+	}
+	tok, ident := t.Scan()
+	if tok != IDENT {
+		parseError("expected IDENT in CmdCreateIndex")
+		return 2, nil
+	}
+	if tok, _ := t.Scan(); tok != PAREN_OPEN {
+		parseError("expected '(' in CmdCreateIndex")
+		return 2, nil
+	}
+	tok, field := t.Scan()
+	if tok != IDENT {
+		parseError("expected IDENT-field in CmdCreateIndex")
+		return 2, nil
+	}
+	if tok, _ := t.Scan(); tok != PAREN_CLOSE {
+		parseError("expected ')' in CmdCreateIndex")
+		return 2, nil
+	}
+	return 0, CmdCreateIndex{ident: ident, field: field}
+}
+
 func(p *Parser) parseCmdChangePw(t *Tokenizer) (int, Cmd) {
 	cmd := CmdChangePw{}
 
@@ -388,7 +1300,7 @@ func(p *Parser) parseCmdLocal(t *Tokenizer) (int, Cmd) {
 	tok, ident := t.Scan()
 	if tok == KV_DELEGATION {
 		return p.parseCmdSetDeleg(t)
-	} else if tok != IDENT {
+	} else if tok != IDENT || isQualified(ident) {
 		parseError("expected IDENT in CmdLocal")
 		return 2, nil
 	}
@@ -441,7 +1353,7 @@ func(p *Parser) parseCmdAppend(t *Tokenizer) (int, Cmd) {
 func(p *Parser) parseCmdForeach(t *Tokenizer) (int, Cmd) {
 	// get identifier
 	tok, identE := t.Scan()
-	if tok != IDENT {
+	if tok != IDENT || isQualified(identE) {
 		parseError("expected IDENT-E in CmdForeach")
 		return 2, nil
 	}
@@ -474,6 +1386,35 @@ func(p *Parser) parseCmdForeach(t *Tokenizer) (int, Cmd) {
 	return 2, nil
 }
 
+// sort x [by f] [desc]
+func(*Parser) parseCmdSort(t *Tokenizer) (int, Cmd) {
+	tok, ident := t.Scan()
+	if tok != IDENT {
+		parseError("expected IDENT in CmdSort")
+		return 2, nil
+	}
+	cmd := CmdSort{ident: ident}
+
+	tok, lit := t.Scan()
+	if keyword(tok, lit) == KV_BY {
+		tok, cmd.field = t.Scan()
+		if tok != IDENT {
+			parseError("expected IDENT-field in CmdSort")
+			return 2, nil
+		}
+		tok, lit = t.Scan()
+	}
+	if keyword(tok, lit) == KV_DESC {
+		cmd.desc = true
+		tok, _ = t.Scan()
+	}
+	if tok != EOF {
+		parseError("expected EOF in CmdSort")
+		return 2, nil
+	}
+	return 0, cmd
+}
+
 func(*Parser) parseCmdSetDeleg(t *Tokenizer) (int, Cmd) {
 	// get identifier
 	tok, tgt := t.Scan()
@@ -481,6 +1422,17 @@ func(*Parser) parseCmdSetDeleg(t *Tokenizer) (int, Cmd) {
 		parseError("expected IDENT-tgt in CmdSetDeleg")
 		return 2, nil
 	}
+	// field rights: x.f
+	if tok, lit := t.Scan(); tok == DOT {
+		tok, f := t.Scan()
+		if tok != IDENT {
+			parseError("expected IDENT-field in CmdSetDeleg")
+			return 2, nil
+		}
+		tgt = fieldRightName(tgt, f)
+	} else {
+		t.Unscan(tok, lit)
+	}
 
 	// get identifier
 	tok, q := t.Scan()
@@ -490,12 +1442,13 @@ func(*Parser) parseCmdSetDeleg(t *Tokenizer) (int, Cmd) {
 	}
 
 	// get identifier
-	tok, _ = t.Scan()
+	tok, lit := t.Scan()
 	var r AccessRight
-	switch(tok) {
+	switch(keyword(tok, lit)) {
 	case KV_READ: r = READ
 	case KV_WRITE: r = WRITE
 	case KV_DELEGATE: r = DELEGATE
+	case KV_EXECUTE: r = EXECUTE
 	case KV_APPEND: r = APPEND
 	default: parseError("expected IDENT-right in CmdSetDeleg"); return 2, nil
 	}
@@ -512,14 +1465,52 @@ func(*Parser) parseCmdSetDeleg(t *Tokenizer) (int, Cmd) {
 		parseError("expected IDENT-L in CmdSetDeleg")
 		return 2, nil
 	}
+	cmd := CmdSetDeleg{tgt: tgt, q: q, right: r, p: p}
+
+	// optional lifetime
+	switch tok, lit := t.Scan(); keyword(tok, lit) {
+	case KV_UNTIL:
+		tok, ts := t.Scan()
+		until, err := time.Parse(time.RFC3339, ts)
+		if (tok != TIMESTAMP && tok != STRING) || err != nil {
+			parseError("expected TIMESTAMP in CmdSetDeleg")
+			return 2, nil
+		}
+		cmd.until = until
+	case KV_FOR:
+		tok, d := t.Scan()
+		lifetime, err := time.ParseDuration(d)
+		if tok != STRING || err != nil || lifetime <= 0 {
+			parseError("expected duration STRING in CmdSetDeleg")
+			return 2, nil
+		}
+		cmd.lifetime = lifetime
+	}
 
-	return 0, CmdSetDeleg{tgt, q, r, p}
+	return 0, cmd
+}
+
+// delete x | delete delegation .. | delete denial ..
+func(p *Parser) parseCmdDelete(t *Tokenizer) (int, Cmd) {
+	tok, ident := t.Scan()
+	next, lit := t.Scan()
+	t.Unscan(next, lit)
+	if tok != IDENT || (keyword(tok, ident) == KV_DENIAL && next != EOF) {
+		t.Unscan(tok, ident)
+		return p.parseCmdDeleteDeleg(t)
+	}
+	if tok, _ := t.Scan(); tok != EOF {
+		parseError("expected EOF in CmdDeleteVar")
+		return 2, nil
+	}
+	return 0, CmdDeleteVar{ident: ident}
 }
 
 func(*Parser) parseCmdDeleteDeleg(t *Tokenizer) (int, Cmd) {
-	// read delegation token
-	if tok, _ := t.Scan(); tok != KV_DELEGATION {
-		parseError("expected ARROW in CmdDelDeleg")
+	// read delegation/denial token
+	kind, lit := t.Scan()
+	if kind = keyword(kind, lit); kind != KV_DELEGATION && kind != KV_DENIAL {
+		parseError("expected DELEGATION or DENIAL in CmdDelDeleg")
 		return 2, nil
 	}
 
@@ -529,6 +1520,17 @@ func(*Parser) parseCmdDeleteDeleg(t *Tokenizer) (int, Cmd) {
 		parseError("expected IDENT-tgt in CmdDelDeleg")
 		return 2, nil
 	}
+	// field rights: x.f
+	if tok, lit := t.Scan(); tok == DOT {
+		tok, f := t.Scan()
+		if tok != IDENT {
+			parseError("expected IDENT-field in CmdDelDeleg")
+			return 2, nil
+		}
+		tgt = fieldRightName(tgt, f)
+	} else {
+		t.Unscan(tok, lit)
+	}
 
 	// get identifier
 	tok, q := t.Scan()
@@ -538,12 +1540,13 @@ func(*Parser) parseCmdDeleteDeleg(t *Tokenizer) (int, Cmd) {
 	}
 
 	// get identifier
-	tok, _ = t.Scan()
+	tok, lit = t.Scan()
 	var r AccessRight
-	switch(tok) {
+	switch(keyword(tok, lit)) {
 	case KV_READ: r = READ
 	case KV_WRITE: r = WRITE
 	case KV_DELEGATE: r = DELEGATE
+	case KV_EXECUTE: r = EXECUTE
 	case KV_APPEND: r = APPEND
 	default: parseError("expected IDENT-right in CmdSetDeleg"); return 2, nil
 	}
@@ -561,6 +1564,9 @@ func(*Parser) parseCmdDeleteDeleg(t *Tokenizer) (int, Cmd) {
 		return 2, nil
 	}
 
+	if kind == KV_DENIAL {
+		return 0, CmdDeleteDenial{tgt, q, r, p}
+	}
 	return 0, CmdDeleteDeleg{tgt, q, r, p}
 }
 
@@ -583,9 +1589,172 @@ func(*Parser) parseCmdDefaultDeleg(t *Tokenizer) (int, Cmd) {
 		parseError("expected IDENT in CmdDefDeleg")
 		return 2, nil
 	}
-	return 0, CmdDefaultDeleg{p}
+
+	// optional inheritance mode
+	switch tok, lit := t.Scan(); keyword(tok, lit) {
+	case KV_LIVE: return 0, CmdDefaultDeleg{p: p, setMode: true, live: true}
+	case KV_COPY: return 0, CmdDefaultDeleg{p: p, setMode: true, live: false}
+	}
+	return 0, CmdDefaultDeleg{p: p}
 }
 
 func(*Parser) parseCmdComment(t *Tokenizer) (int, Cmd) {
 	return 0, CmdComment{}
 }
+
+func(*Parser) parseCmdShow(t *Tokenizer) (int, Cmd) {
+	switch tok, lit := t.Scan(); keyword(tok, lit) {
+	case KV_LOCKOUTS:
+		return 0, CmdShowLockouts{}
+	case KV_DELEGATIONS:
+		// get identifier
+		tok, ident := t.Scan()
+		if tok != IDENT {
+			parseError("expected IDENT in CmdShowDelegations")
+			return 2, nil
+		}
+		return 0, CmdShowDelegations{ident}
+	case KV_QUOTA:
+		tok, pr := t.Scan()
+		if tok != IDENT {
+			parseError("expected IDENT in CmdShowQuota")
+			return 2, nil
+		}
+		return 0, CmdShowQuota{pr}
+	case KV_INDEXES:
+		return 0, CmdShowIndexes{}
+	case KV_SCHEMA:
+		tok, name := t.Scan()
+		if tok != IDENT {
+			parseError("expected IDENT in CmdShowSchema")
+			return 2, nil
+		}
+		return 0, CmdShowSchema{name}
+	}
+	parseError("expected LOCKOUTS, DELEGATIONS, QUOTA, INDEXES or SCHEMA in CmdShow")
+	return 2, nil
+}
+
+func(*Parser) parseCmdDeclareSchema(t *Tokenizer) (int, Cmd) {
+	if tok, lit := t.Scan(); keyword(tok, lit) != KV_SCHEMA {
+		parseError("expected SCHEMA in CmdDeclareSchema")
+		return 2, nil
+	}
+	tok, name := t.Scan()
+	if tok != IDENT {
+		parseError("expected IDENT in CmdDeclareSchema")
+		return 2, nil
+	}
+	if tok, _ := t.Scan(); tok != BRACKET_OPEN {
+		parseError("expected '{' in CmdDeclareSchema")
+		return 2, nil
+	}
+	cmd := CmdDeclareSchema{name: name, fields: make(map[string]bool, 0)}
+	for {
+		tok, field := t.Scan()
+		if tok != IDENT {
+			parseError("expected IDENT-field in CmdDeclareSchema")
+			return 2, nil
+		}
+		if _, exists := cmd.fields[field]; exists {
+			parseError("duplicate field in CmdDeclareSchema")
+			return 2, nil
+		}
+		cmd.fields[field] = true
+		tok, _ = t.Scan()
+		if tok == QUESTION {
+			cmd.fields[field] = false
+			tok, _ = t.Scan()
+		}
+		if tok == BRACKET_CLOSE {
+			return 0, cmd
+		} else if tok != COMMA {
+			parseError("expected ',' or '}' in CmdDeclareSchema")
+			return 2, nil
+		}
+	}
+}
+
+func(*Parser) parseCmdBindSchema(t *Tokenizer) (int, Cmd) {
+	if tok, lit := t.Scan(); keyword(tok, lit) != KV_SCHEMA {
+		parseError("expected SCHEMA in CmdBindSchema")
+		return 2, nil
+	}
+	tok, name := t.Scan()
+	if tok != IDENT {
+		parseError("expected IDENT in CmdBindSchema")
+		return 2, nil
+	}
+	if tok, _ := t.Scan(); tok != KV_TO {
+		parseError("expected TO in CmdBindSchema")
+		return 2, nil
+	}
+	tok, ident := t.Scan()
+	if tok != IDENT {
+		parseError("expected IDENT-var in CmdBindSchema")
+		return 2, nil
+	}
+	return 0, CmdBindSchema{name: name, ident: ident}
+}
+
+func(*Parser) parseCmdClearLockouts(t *Tokenizer) (int, Cmd) {
+	// read lockouts token
+	if tok, lit := t.Scan(); keyword(tok, lit) != KV_LOCKOUTS {
+		parseError("expected LOCKOUTS in CmdClearLockouts")
+		return 2, nil
+	}
+
+	// get optional principal or remote host
+	tok, name := t.Scan()
+	switch tok {
+	case EOF: return 0, CmdClearLockouts{}
+	case IDENT, STRING: return 0, CmdClearLockouts{name}
+	case COMMENT: return 0, CmdClearLockouts{}
+	}
+	parseError("expected IDENT or STRING in CmdClearLockouts")
+	return 2, nil
+}
+
+func(*Parser) parseCmdGrantAdmin(t *Tokenizer) (int, Cmd) {
+	// read role, `admin` is a principal name, so no keyword
+	if tok, role := t.Scan(); tok != IDENT || role != USER_ADMIN {
+		parseError("expected admin in CmdGrantAdmin")
+		return 2, nil
+	}
+
+	// read to token
+	if tok, _ := t.Scan(); tok != KV_TO {
+		parseError("expected TO in CmdGrantAdmin")
+		return 2, nil
+	}
+
+	// get principal
+	tok, p := t.Scan()
+	if tok != IDENT {
+		parseError("expected IDENT in CmdGrantAdmin")
+		return 2, nil
+	}
+	return 0, CmdGrantAdmin{p}
+}
+
+func(*Parser) parseCmdRevokeAdmin(t *Tokenizer) (int, Cmd) {
+	// read role
+	if tok, role := t.Scan(); tok != IDENT || role != USER_ADMIN {
+		parseError("expected admin in CmdRevokeAdmin")
+		return 2, nil
+	}
+
+	// read from token
+	if tok, lit := t.Scan(); keyword(tok, lit) != KV_FROM {
+		parseError("expected FROM in CmdRevokeAdmin")
+		return 2, nil
+	}
+
+	// get principal
+	tok, p := t.Scan()
+	if tok != IDENT {
+		parseError("expected IDENT in CmdRevokeAdmin")
+		return 2, nil
+	}
+	return 0, CmdRevokeAdmin{p}
+}
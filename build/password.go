@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// passwords are only kept as salted PBKDF2-SHA256 hashes.
+// the iteration count is stored per user, so changing the configured cost
+// only affects passwords set afterwards.
+
+const (
+	PW_SALT_LEN int = 16
+	PW_HASH_LEN int = 32
+)
+
+// used to spend the same time on logins of unknown principals
+var dummySalt = make([]byte, PW_SALT_LEN)
+
+func hashPassword(pw string, salt []byte, iterations int) []byte {
+	h, err := pbkdf2.Key(sha256.New, pw, salt, iterations, PW_HASH_LEN)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+func (u *EntryUser) setPassword(pw string) {
+	salt := make([]byte, PW_SALT_LEN)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	u.salt = salt
+	u.iterations = pwIterations
+	u.pwHash = hashPassword(pw, salt, pwIterations)
+}
+
+func (u *EntryUser) checkPassword(pw string) bool {
+	h := hashPassword(pw, u.salt, u.iterations)
+	return subtle.ConstantTimeCompare(h, u.pwHash) == 1
+}
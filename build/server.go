@@ -16,11 +16,25 @@ import (
 var legitStringRegex *regexp.Regexp
 var legitIdentifierRegex *regexp.Regexp
 var legitCommentRegex *regexp.Regexp
+var legitTimestampRegex *regexp.Regexp
 var globals *GlobalEnv
 
 func main() {
 	initialize()
 
+	if len(os.Args) == 3 && os.Args[1] == "verify-audit" {
+		os.Exit(runVerifyAudit(os.Args[2]))
+	}
+
+	if auditLogPath != "" {
+		a, err := OpenAuditLog(auditLogPath)
+		if err != nil {
+			log.Printf("Cannot open audit log: %v", err)
+			os.Exit(255)
+		}
+		globals.audit = a
+	}
+
 	port := "6666"
 	password := "admin"
 	if len(os.Args) >= 2 {
@@ -40,7 +54,8 @@ func main() {
 		}
 	}
 
-	log.Printf("Starting server on port %s w/ password %s", port, password)
+	globals.db.changePassword(USER_ADMIN, password)
+	log.Printf("Starting server on port %s", port)
 
 	ln, err := net.Listen("tcp", ":"+port)
 	vcheck(err)
@@ -74,7 +89,7 @@ func main() {
 			if (tlen >= 3 && (string(bufCmd[tlen-3:tlen]) ==  "***")) ||
 					(tlen >= 4 && (string(bufCmd[tlen-4:tlen]) ==  "***\n")) ||
 					lineContainsTermination(string(bufCmd)) {
-				r, s := executeProgram(string(bufCmd))
+				r, s := executeProgram(string(bufCmd), conn.RemoteAddr().String())
 				results := fmt.Sprintf("%s\n", r)
 				_, err := conn.Write([]byte(results))
 				vcheck(err)
@@ -99,7 +114,7 @@ func lineContainsTermination(p string) bool {
 	return false
 }
 
-func executeProgram(p string) (string, int) {
+func executeProgram(p, remote string) (string, int) {
 	// parse
 	res, prg := parseProgram(p)
 	if res != 0 || prg == nil {
@@ -107,16 +122,24 @@ func executeProgram(p string) (string, int) {
 	}
 
 	// backup db
+	globals.sweep()
 	SnapshotDatabase(globals)
 
 	// set up program env
-	env := NewProgramEnv(globals)
+	env := NewProgramEnv(globals, remote)
 
 	// execute
 	res = prg.execute(env)
 	if res != TERMINATED {
 		// rollback db
 		RollbackDatabase(globals)
+	} else {
+		for _, f := range env.onCommit {
+			f()
+		}
+	}
+	if globals.audit != nil {
+		globals.audit.write(env.audit, res == TERMINATED)
 	}
 
 	result := ""
@@ -134,9 +157,19 @@ func executeProgram(p string) (string, int) {
 
 func initialize() {
 	legitStringRegex = regexp.MustCompile(`[A-Za-z0-9_ ,;\.?!-]*`)
-	legitIdentifierRegex = regexp.MustCompile(`[A-Za-z][A-Za-z0-9_]*`)
+	legitIdentifierRegex = regexp.MustCompile(`[A-Za-z][A-Za-z0-9_]*(::[A-Za-z][A-Za-z0-9_]*)?`)
 	legitCommentRegex = regexp.MustCompile(`[A-Za-z0-9_ ,;\.?!-]*`)
+	legitTimestampRegex = regexp.MustCompile(`[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}:[0-9]{2}(\.[0-9]+)?(Z|[+-][0-9]{2}:[0-9]{2})`)
+	loadConfig()
 	globals = NewGlobalEnv()
+	if fixedClock != "" {
+		t, err := time.Parse(time.RFC3339, fixedClock)
+		if err != nil {
+			log.Printf("Invalid BIBIFI_CLOCK")
+			os.Exit(255)
+		}
+		globals.clock = func() time.Time { return t }
+	}
 }
 
 func isArgPortLegit(port string) bool {
@@ -164,6 +197,10 @@ func isValidIdentifier(s string) bool {
 	return len(s) <= 255 && s == legitIdentifierRegex.FindString(s)
 }
 
+func isValidTimestamp(s string) bool {
+	return s == legitTimestampRegex.FindString(s)
+}
+
 func isValidComment(s string) bool {
 	return s == legitCommentRegex.FindString(s)
 }
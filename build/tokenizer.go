@@ -6,6 +6,7 @@ import (
 	"bufio"
 	"io"
 	"bytes"
+	"strconv"
 	"strings"
 )
 
@@ -19,6 +20,8 @@ const (
 	// Literals
 	IDENT
 	STRING
+	TIMESTAMP		// "<RFC3339>", not a valid STRING
+	NUMBER			// 42, -7
 
 	// Misc
 	DOT				// .
@@ -28,6 +31,12 @@ const (
 	ARROW			// ->
 	BRACKET_OPEN	// {
 	BRACKET_CLOSE	// }
+	PAREN_OPEN		// (
+	PAREN_CLOSE		// )
+	SQUARE_OPEN		// [
+	SQUARE_CLOSE	// ]
+	COLON			// :
+	QUESTION		// ?
 	COMMENT			// //
 
 	// Specific Keywords
@@ -65,6 +74,63 @@ const (
 	KV_FILTEREACH
 	KV_WITH
 	KV_LET
+
+	KV_SHOW
+	KV_CLEAR
+	KV_LOCKOUTS
+
+	KV_UNTIL
+	KV_FOR
+	KV_DELEGATIONS
+	KV_DENIAL
+	KV_LIVE
+	KV_COPY
+	KV_GRANT
+	KV_REVOKE
+	KV_FROM
+	KV_READONLY
+
+	KV_SORT
+	KV_BY
+	KV_DESC
+
+	KV_META
+
+	KV_AT
+	KV_VERSION
+	KV_OF
+	KV_REVERT
+	KV_HISTORY
+
+	KV_QUOTA
+	KV_VARS
+	KV_BYTES
+	KV_UNLIMITED
+
+	KV_IF
+	KV_THEN
+	KV_ELSE
+	KV_END
+
+	KV_EXECUTE
+	KV_DEFINE
+	KV_PROCEDURE
+	KV_CALL
+	KV_DEFINER
+
+	KV_ON
+	KV_REJECT
+
+	KV_SELECT
+	KV_WHERE
+	KV_AND
+
+	KV_INDEX
+	KV_INDEXES
+
+	KV_DECLARE
+	KV_SCHEMA
+	KV_BIND
 )
 
 var eof = rune(0)
@@ -77,6 +143,7 @@ type ScanItem struct {
 type Tokenizer struct {
 	r *bufio.Reader
 	undo []*ScanItem
+	stopAt Token // scanned as EOF (and kept), ILLEGAL = none
 }
 
 func NewTokenizer(r io.Reader) *Tokenizer {
@@ -94,11 +161,24 @@ func (t *Tokenizer) read() rune {
 func (t *Tokenizer) unread() { _ = t.r.UnreadRune() }
 
 func (t *Tokenizer) Unscan(tok Token, e string) {
+	if tok == EOF {
+		// scanned again anyway, and mustn't hide a stopAt token
+		return
+	}
 	t.undo = append(t.undo, &ScanItem{token: tok, expr: e})
 }
 
 // returns next token and literal value
 func (t *Tokenizer) Scan() (tok Token, lit string) {
+	tok, lit = t.scan()
+	if t.stopAt != ILLEGAL && keyword(tok, lit) == t.stopAt {
+		t.Unscan(tok, lit)
+		return EOF, ""
+	}
+	return tok, lit
+}
+
+func (t *Tokenizer) scan() (tok Token, lit string) {
 	if len(t.undo) > 0 {
 		// pop
 		var si *ScanItem
@@ -124,6 +204,10 @@ func (t *Tokenizer) Scan() (tok Token, lit string) {
 		t.unread()
 		return t.scanIdent()
 	}
+	if isDigit(ch) {
+		t.unread()
+		return t.scanNumber("")
+	}
 
 	// otherwise read the individual char
 	switch ch {
@@ -137,17 +221,31 @@ func (t *Tokenizer) Scan() (tok Token, lit string) {
 		return BRACKET_OPEN, "{"
 	case '}':
 		return BRACKET_CLOSE, "}"
+	case '(':
+		return PAREN_OPEN, "("
+	case ')':
+		return PAREN_CLOSE, ")"
 	case '[':
 		if t.read() == ']' {
 			return EMPTYLIST, "[]"
 		} else {
-			return ILLEGAL, ""
+			t.unread()
+			return SQUARE_OPEN, "["
 		}
+	case ']':
+		return SQUARE_CLOSE, "]"
+	case ':':
+		return COLON, ":"
+	case '?':
+		return QUESTION, "?"
 	case '=':
 		return EQUAL, "="
 	case '-':
-		if t.read() == '>' {
+		if ch2 := t.read(); ch2 == '>' {
 			return ARROW, "->"
+		} else if isDigit(ch2) {
+			t.unread()
+			return t.scanNumber("-")
 		} else {
 			return ILLEGAL, ""
 		}
@@ -177,6 +275,13 @@ func (t *Tokenizer) scanIdent() (tok Token, lit string) {
 	// Read every subsequent ident char into the buffer.
 	// non-ident char and eof will cause loop to exit
 	for {
+		// namespace separator: alice::x
+		if b, err := t.r.Peek(2); err == nil && string(b) == "::" {
+			t.read()
+			t.read()
+			_, _ = buf.WriteString("::")
+			continue
+		}
 		if ch := t.read(); ch == eof {
 			break
 		} else if !isLetter(ch) && !isDigit(ch) && ch != '_' {
@@ -261,6 +366,88 @@ func (t *Tokenizer) scanIdent() (tok Token, lit string) {
 	}
 }
 
+// words that are only keywords where the parser expects them, anywhere else
+// they are identifiers (`set show = "v"`), see keyword
+var contextKeywords = map[string]Token{
+	"SHOW": KV_SHOW,
+	"CLEAR": KV_CLEAR,
+	"LOCKOUTS": KV_LOCKOUTS,
+	"UNTIL": KV_UNTIL,
+	"FOR": KV_FOR,
+	"DELEGATIONS": KV_DELEGATIONS,
+	"DENIAL": KV_DENIAL,
+	"LIVE": KV_LIVE,
+	"COPY": KV_COPY,
+	"GRANT": KV_GRANT,
+	"REVOKE": KV_REVOKE,
+	"FROM": KV_FROM,
+	"READONLY": KV_READONLY,
+	"SORT": KV_SORT,
+	"BY": KV_BY,
+	"DESC": KV_DESC,
+	"META": KV_META,
+	"AT": KV_AT,
+	"VERSION": KV_VERSION,
+	"OF": KV_OF,
+	"REVERT": KV_REVERT,
+	"HISTORY": KV_HISTORY,
+	"QUOTA": KV_QUOTA,
+	"VARS": KV_VARS,
+	"BYTES": KV_BYTES,
+	"UNLIMITED": KV_UNLIMITED,
+	"IF": KV_IF,
+	"THEN": KV_THEN,
+	"ELSE": KV_ELSE,
+	"END": KV_END,
+	"EXECUTE": KV_EXECUTE,
+	"DEFINE": KV_DEFINE,
+	"PROCEDURE": KV_PROCEDURE,
+	"CALL": KV_CALL,
+	"DEFINER": KV_DEFINER,
+	"ON": KV_ON,
+	"REJECT": KV_REJECT,
+	"SELECT": KV_SELECT,
+	"WHERE": KV_WHERE,
+	"AND": KV_AND,
+	"INDEX": KV_INDEX,
+	"INDEXES": KV_INDEXES,
+	"DECLARE": KV_DECLARE,
+	"SCHEMA": KV_SCHEMA,
+	"BIND": KV_BIND,
+}
+
+// the contextual keyword an IDENT spells, or tok itself
+func keyword(tok Token, lit string) Token {
+	if tok == IDENT {
+		if kw, ok := contextKeywords[strings.ToUpper(lit)]; ok {
+			return kw
+		}
+	}
+	return tok
+}
+
+// numbers must fit into an int64, see ExprNumber
+func (t *Tokenizer) scanNumber(sign string) (tok Token, lit string) {
+	var buf bytes.Buffer
+	buf.WriteString(sign)
+	for {
+		if ch := t.read(); ch == eof {
+			break
+		} else if isLetter(ch) || ch == '_' {
+			return ILLEGAL, "invalidNumber"
+		} else if !isDigit(ch) {
+			t.unread()
+			break
+		} else {
+			_, _ = buf.WriteRune(ch)
+		}
+	}
+	if _, err := strconv.ParseInt(buf.String(), 10, 64); err != nil {
+		return ILLEGAL, "invalidNumber"
+	}
+	return NUMBER, buf.String()
+}
+
 func (t *Tokenizer) scanString() (tok Token, lit string) {
 	var buf bytes.Buffer
 
@@ -271,6 +458,8 @@ func (t *Tokenizer) scanString() (tok Token, lit string) {
 		} else if ch == '"' {
 			if isValidString(buf.String()) {
 				return STRING, buf.String()
+			} else if isValidTimestamp(buf.String()) {
+				return TIMESTAMP, buf.String()
 			} else {
 				return ILLEGAL, "invalidString"
 			}
@@ -0,0 +1,139 @@
+#!/usr/bin/python
+
+# audit log test, needs the environment, so it can't be a json test:
+# committed and rolled back programs, unparsable programs, password
+# redaction, and verify-audit on an intact, a tampered and a truncated log
+
+import json
+import os
+import shutil
+import socket
+import subprocess
+import sys
+import tempfile
+import time
+
+if len(sys.argv) != 2:
+	print( "usage: ./testaudit.py <server>")
+	exit( 1)
+serverFile = os.path.abspath( sys.argv[1])
+
+failed = False
+
+def check( ok, msg):
+	global failed
+	if ok:
+		print( "PASS " + msg)
+	else:
+		print( "FAIL " + msg)
+		failed = True
+
+def runServer( port, log):
+	env = dict( os.environ)
+	env['BIBIFI_AUDIT_LOG'] = log
+	p = subprocess.Popen( [serverFile, str(port)], env=env)
+	time.sleep(1)
+
+	p.poll()
+	if p.returncode == 63:
+		return runServer( port + 1, log)
+
+	return (p, port)
+
+def send( port, prog):
+	s = socket.socket()
+	s.connect(("localhost", port))
+	s.sendall( prog.encode())
+	buf = b''
+	while True:
+		data = s.recv(4096)
+		if not data:
+			break
+		buf += data
+	s.close()
+	return [json.loads(l) for l in buf.decode().split('\n') if l.strip()]
+
+def readLog( log):
+	f = open( log, 'r')
+	lines = [json.loads(l) for l in f.read().split('\n') if l.strip()]
+	f.close()
+	return lines
+
+def verify( log):
+	return subprocess.call( [serverFile, 'verify-audit', log], stdout=open(os.devnull, 'w'))
+
+# go
+
+tmp = tempfile.mkdtemp()
+log = os.path.join( tmp, 'audit.log')
+(p, port) = runServer( 6400, log)
+
+# committed
+send( port, 'as principal admin password "admin" do\n'
+	'create principal bob "B0bSecretPW"\n'
+	'change password bob "N3wSecretPW"\n'
+	'set x = "v"\n'
+	'return x\n***\n')
+# rolled back
+send( port, 'as principal admin password "admin" do\n'
+	'set y = "w"\n'
+	'return nope\n***\n')
+# never audited, it doesn't parse
+send( port, 'as principal admin password "admin" do\n'
+	'set = "w"\n'
+	'return y\n***\n')
+# denied login
+send( port, 'as principal bob password "wrongPW" do\n'
+	'return x\n***\n')
+
+p.terminate()
+p.wait()
+
+entries = readLog( log)
+cmds = [(e['cmd'], e['target'] if 'target' in e else '', e['committed']) for e in entries]
+check( cmds == [
+		('as_principal', 'admin', True),
+		('create_principal', 'bob', True),
+		('change_password', 'bob', True),
+		('set', 'x', True),
+		('return', '', True),
+		('as_principal', 'admin', False),
+		('set', 'y', False),
+		('return', '', False),
+		('as_principal', 'bob', False),
+	], "entries of committed and rolled back programs")
+check( [e['status'] for e in entries][-2:] == ['FAILED', 'DENIED'], "statuses of failed programs")
+
+f = open( log, 'r')
+raw = f.read()
+f.close()
+check( 'B0bSecretPW' not in raw and 'N3wSecretPW' not in raw and 'wrongPW' not in raw, "passwords are never logged")
+
+check( verify( log) == 0, "verify-audit accepts an intact log")
+
+# tampered: a rolled back write claims to be committed
+tampered = os.path.join( tmp, 'tampered.log')
+lines = raw.split('\n')
+lines[6] = lines[6].replace('"committed":false', '"committed":true')
+f = open( tampered, 'w')
+f.write( '\n'.join( lines))
+f.close()
+check( verify( tampered) == 1, "verify-audit rejects a tampered line")
+
+# removed line in the middle
+removed = os.path.join( tmp, 'removed.log')
+f = open( removed, 'w')
+f.write( '\n'.join( lines[:3] + lines[4:]))
+f.close()
+check( verify( removed) == 1, "verify-audit rejects a removed line")
+
+# a truncated tail still verifies, see README
+truncated = os.path.join( tmp, 'truncated.log')
+f = open( truncated, 'w')
+f.write( '\n'.join( raw.split('\n')[:4]) + '\n')
+f.close()
+check( verify( truncated) == 0, "verify-audit accepts a truncated log")
+
+shutil.rmtree( tmp)
+if failed:
+	exit( 1)